@@ -0,0 +1,78 @@
+package makex
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+)
+
+// RunAffectedBy is like Run, except that it builds the targets that
+// transitively depend on any of changedFiles (such as the files changed
+// between two VCS revisions), whether or not they are stale, and no others.
+// Targets are built in the same order as Run would build them, and the
+// services that they depend on are started as usual.
+func (m *Maker) RunAffectedBy(changedFiles []string) error {
+	affected := m.affectedBy(changedFiles)
+	selected := make(map[string]bool, len(affected))
+	var addServices func(target string)
+	addServices = func(target string) {
+		for _, prereq := range m.dag[target] {
+			if !selected[prereq] && isService(m.rule(prereq)) {
+				selected[prereq] = true
+				addServices(prereq)
+			}
+		}
+	}
+	for target := range affected {
+		selected[target] = true
+		addServices(target)
+	}
+
+	m.forced = affected
+	defer func() { m.forced = nil }()
+	return m.runSelected(context.Background(), selected)
+}
+
+// affectedBy returns the set of targets that transitively depend on any of
+// changedFiles.
+func (m *Maker) affectedBy(changedFiles []string) map[string]bool {
+	affected := make(map[string]bool)
+	for _, file := range changedFiles {
+		m.walkDependents(filepath.Clean(file), affected)
+	}
+	return affected
+}
+
+// Dependents returns the sorted list of targets that directly depend on
+// target (which may be a target or any other file that is a prereq of a
+// target). Only targets that this Maker would build to make its goals are
+// considered.
+func (m *Maker) Dependents(target string) []string {
+	dependents := append([]string{}, m.dependents[filepath.Clean(target)]...)
+	sort.Strings(dependents)
+	return dependents
+}
+
+// TransitiveDependents returns the sorted list of targets that directly or
+// indirectly depend on target (see Dependents).
+func (m *Maker) TransitiveDependents(target string) []string {
+	seen := make(map[string]bool)
+	m.walkDependents(filepath.Clean(target), seen)
+	dependents := make([]string, 0, len(seen))
+	for dependent := range seen {
+		dependents = append(dependents, dependent)
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// walkDependents adds all targets that transitively depend on target (which
+// must be a clean path) to seen.
+func (m *Maker) walkDependents(target string, seen map[string]bool) {
+	for _, dependent := range m.dependents[target] {
+		if !seen[dependent] {
+			seen[dependent] = true
+			m.walkDependents(filepath.Clean(dependent), seen)
+		}
+	}
+}
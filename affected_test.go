@@ -0,0 +1,152 @@
+package makex
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_affectedBy(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x", "y"}},
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"x.o"}},
+		&BasicRule{TargetFile: "x.o", PrereqFiles: []string{"x.c", "common.h"}},
+		&BasicRule{TargetFile: "y", PrereqFiles: []string{"y.c"}},
+	}}
+	var conf Config
+	mk := conf.NewMaker(mf, "all")
+
+	tests := []struct {
+		changed []string
+		want    map[string]bool
+	}{
+		{changed: nil, want: map[string]bool{}},
+		{changed: []string{"./y.c"}, want: map[string]bool{"y": true, "all": true}},
+		{changed: []string{"common.h"}, want: map[string]bool{"x.o": true, "x": true, "all": true}},
+		{changed: []string{"unrelated.c"}, want: map[string]bool{}},
+	}
+	for _, test := range tests {
+		if got := mk.affectedBy(test.changed); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got affected %v, want %v", test.changed, got, test.want)
+		}
+	}
+}
+
+func TestMaker_Dependents(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x", "y"}},
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"common.h", "x.c"}},
+		&BasicRule{TargetFile: "y", PrereqFiles: []string{"common.h", "x"}},
+	}}
+	var conf Config
+	mk := conf.NewMaker(mf, "all")
+
+	if got, want := mk.Dependents("common.h"), []string{"x", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got dependents %v, want %v", got, want)
+	}
+	if got, want := mk.Dependents("all"), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got dependents %v, want %v", got, want)
+	}
+	if got, want := mk.TransitiveDependents("x.c"), []string{"all", "x", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got transitive dependents %v, want %v", got, want)
+	}
+}
+
+func TestMaker_RunAffectedBy(t *testing.T) {
+	var built []string
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Builtins: map[string]func(Rule, []string) error{
+			"build": func(rule Rule, args []string) error {
+				built = append(built, rule.Target())
+				return nil
+			},
+		},
+	}
+	recipes := []string{"@makex:call build"}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x", "y"}, RecipeCmds: recipes},
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"x.c"}, RecipeCmds: recipes},
+		&BasicRule{TargetFile: "y", PrereqFiles: []string{"y.c"}, RecipeCmds: recipes},
+	}}
+	if err := conf.NewMaker(mf, "all").RunAffectedBy([]string{"x.c"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"x", "all"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("got built %v, want %v", built, want)
+	}
+}
+
+func TestMaker_RunAffectedBy_afterRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var built []string
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"x.c": ""}))
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           fs,
+		ManifestPath: filepath.Join(tmpDir, "manifest.json"),
+		Builtins: map[string]func(Rule, []string) error{
+			"build": func(rule Rule, args []string) error {
+				built = append(built, rule.Target())
+				w, err := fs.Create(rule.Target())
+				if err != nil {
+					return err
+				}
+				return w.Close()
+			},
+		},
+	}
+	recipes := []string{"@makex:call build"}
+	// x is up to date after Run, but RunAffectedBy builds it anyway.
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"all"}},
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"x.c"}, RecipeCmds: recipes, Once: true},
+	}}
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(conf.ManifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	built = nil
+	if err := mk.RunAffectedBy([]string{"x.c"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"x"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("got built %v, want %v (the run-once recipes should run once per build)", built, want)
+	}
+	data, err := ioutil.ReadFile(conf.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, target := range manifest.Targets {
+		targets = append(targets, target.Target)
+	}
+	if want := []string{"x"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("got manifest targets %v, want %v", targets, want)
+	}
+}
@@ -0,0 +1,79 @@
+package makex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// builtinCallPrefix begins a recipe line that calls a builtin function (see
+// Config.Builtins) instead of running a shell command.
+const builtinCallPrefix = "@makex:call"
+
+// parseBuiltinCall parses a recipe line of the form "@makex:call name args...".
+// Single- and double-quoted args (such as those produced by Quote) are
+// unquoted.
+func parseBuiltinCall(recipe string) (name string, args []string, ok bool) {
+	recipe = strings.TrimSpace(recipe)
+	if !strings.HasPrefix(recipe, builtinCallPrefix) {
+		return "", nil, false
+	}
+	rest := recipe[len(builtinCallPrefix):]
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return "", nil, false
+	}
+	fields := splitArgs(rest)
+	if len(fields) == 0 {
+		return "", nil, true
+	}
+	return fields[0], fields[1:], true
+}
+
+// callBuiltin calls the builtin function with the given name.
+func (c *Config) callBuiltin(rule Rule, name string, args []string) error {
+	if name == "" {
+		return fmt.Errorf("%s: missing builtin name", builtinCallPrefix)
+	}
+	f, present := c.Builtins[name]
+	if !present {
+		return fmt.Errorf("%s: no builtin named %q", builtinCallPrefix, name)
+	}
+	return f(rule, args)
+}
+
+// splitArgs splits s into whitespace-separated fields. Quotation marks (' or ")
+// group characters, including whitespace, into a single field and are
+// removed.
+func splitArgs(s string) []string {
+	var (
+		fields  []string
+		field   []byte
+		inField bool
+		quote   byte
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field = append(field, c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, string(field))
+				field, inField = field[:0], false
+			}
+		default:
+			field = append(field, c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
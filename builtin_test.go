@@ -0,0 +1,65 @@
+package makex
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestParseBuiltinCall(t *testing.T) {
+	tests := map[string]struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		"echo hi":                        {ok: false},
+		"@makex:callfoo":                 {ok: false},
+		"@makex:call foo":                {name: "foo", args: []string{}, ok: true},
+		"@makex:call cp a 'b c' \"d e\"": {name: "cp", args: []string{"a", "b c", "d e"}, ok: true},
+	}
+	for recipe, want := range tests {
+		name, args, ok := parseBuiltinCall(recipe)
+		if ok != want.ok {
+			t.Errorf("%q: got ok == %v, want %v", recipe, ok, want.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if name != want.name || !reflect.DeepEqual(args, want.args) {
+			t.Errorf("%q: got builtin %q %q, want %q %q", recipe, name, args, want.name, want.args)
+		}
+	}
+}
+
+func TestMaker_Run_builtin(t *testing.T) {
+	var calls [][]string
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Builtins: map[string]func(Rule, []string) error{
+			"record": func(rule Rule, args []string) error {
+				calls = append(calls, append([]string{rule.Target()}, args...))
+				return nil
+			},
+		},
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"@makex:call record $@ $<"}},
+		},
+	}
+	mk := conf.NewMaker(mf, "x")
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"x", "x", "y"}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got builtin calls %q, want %q", calls, want)
+	}
+
+	mf.Rules[0].(*BasicRule).RecipeCmds = []string{"@makex:call nonexistent"}
+	if err := conf.NewMaker(mf, "x").Run(); err == nil {
+		t.Error("got no error calling nonexistent builtin")
+	}
+}
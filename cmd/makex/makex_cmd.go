@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 
 	"sourcegraph.com/sourcegraph/makex"
 )
@@ -13,6 +14,13 @@ import (
 var expand = flag.Bool("x", true, "expand globs in makefile prereqs")
 var cwd = flag.String("C", "", "change to this directory before doing anything")
 var file = flag.String("f", "Makefile", "path to Makefile")
+var checkPrereqOrder = flag.Bool("check-prereq-order", false, "expand globs twice and report rules whose prereqs are in a nondeterministic order, then exit")
+var printDatabase = flag.Bool("p", false, "print the makefile's variables and rules (like make -p) instead of building")
+var savePlan = flag.String("save-plan", "", "write the build plan (the targets and commands that would be run) to this file instead of building")
+var runPlan = flag.String("run-plan", "", "run the build plan in this file (written by -save-plan) instead of the makefile's goals")
+var checkRecipes = flag.Bool("check-recipes", false, "check that the recipes of the targets that need to be built can be expanded, then exit")
+var tag = flag.String("tag", "", "only build the targets (and their prereqs) that have this tag")
+var lint = flag.Bool("lint", false, "check the makefile for likely mistakes and exit (with status 1 if any are found)")
 
 func main() {
 	flag.Usage = func() {
@@ -35,12 +43,17 @@ The options are:
 
 	conf := makex.Default
 	makex.Flags(nil, &conf, "")
+	conf.ApplyMakeFlags(os.Getenv("MAKEFLAGS"))
 	flag.Parse()
 
 	data, err := ioutil.ReadFile(*file)
 	if err != nil {
 		log.Fatal(err)
 	}
+	makefilePath, err := filepath.Abs(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if *cwd != "" {
 		err := os.Chdir(*cwd)
@@ -54,6 +67,39 @@ The options are:
 		log.Fatal(err)
 	}
 
+	// Record the makefile's path relative to the (new) current directory,
+	// which is the root of the filesystem that targets are built in.
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, makefilePath); err == nil {
+			mf.Sources = []string{rel}
+		}
+	}
+
+	if *lint {
+		issues := mf.Lint(makex.DefaultLintRules)
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		if len(issues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *checkPrereqOrder {
+		diffs, err := conf.PrereqOrderDiffs(mf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, d := range diffs {
+			fmt.Printf("%s: prereqs are in a nondeterministic order (globs: %v)\n\tfirst:  %v\n\tsecond: %v\n", d.Target, d.Globs, d.First, d.Second)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	goals := flag.Args()
 	if len(goals) == 0 {
 		// Find the first rule that doesn't begin with a ".".
@@ -71,6 +117,60 @@ The options are:
 
 	mk := conf.NewMaker(mf, goals...)
 
+	if *printDatabase {
+		if err := mk.WriteDatabase(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *checkRecipes {
+		if err := mk.ValidateRecipes(); err != nil {
+			if errs, ok := err.(makex.Errors); ok {
+				for _, err := range errs {
+					if err, ok := err.(makex.RuleBuildError); ok {
+						log.Printf("%s: %s", err.Rule.Target(), err)
+						continue
+					}
+					log.Print(err)
+				}
+				os.Exit(1)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *savePlan != "" {
+		f, err := os.Create(*savePlan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mk.SavePlan(f); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *runPlan != "" {
+		f, err := os.Open(*runPlan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p, err := makex.LoadPlan(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := mk.RunPlan(p); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	targetSets, err := mk.TargetSetsNeedingBuild()
 	if err != nil {
 		log.Fatal(err)
@@ -85,7 +185,11 @@ The options are:
 		return
 	}
 
-	err = mk.Run()
+	if *tag != "" {
+		err = mk.RunTagged(*tag)
+	} else {
+		err = mk.Run()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
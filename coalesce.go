@@ -0,0 +1,131 @@
+package makex
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/neelance/parallel"
+)
+
+// A coalescedBuild is the build of a target whose recipes are identical to
+// those of other targets in its target set (see
+// Config.CoalesceIdenticalRecipes).
+type coalescedBuild struct {
+	leader string        // the target that is built normally
+	done   chan struct{} // closed when the leader's build finishes
+	err    error         // the leader's error, if any (set before done is closed)
+
+	// recipes are the leader's expanded recipes (set before done is
+	// closed).
+	recipes []string
+}
+
+// coalesce groups targets (which are sorted) by their expanded recipes. For
+// each group of more than one target, the first target is the leader: leaders maps it to its
+// build, and followers maps each of the others to the same build.
+func (m *Maker) coalesce(targets []string) (leaders, followers map[string]*coalescedBuild) {
+	byRecipes := make(map[string]*coalescedBuild)
+	for _, target := range targets {
+		rule := m.rule(target)
+		if len(rule.Recipes()) == 0 || isService(rule) || isRunOnce(rule) || m.stagesTarget(rule) {
+			continue
+		}
+		key, ok := m.expandedRecipes(rule)
+		if !ok {
+			continue
+		}
+		b, seen := byRecipes[key]
+		if !seen {
+			byRecipes[key] = &coalescedBuild{leader: target, done: make(chan struct{})}
+			continue
+		}
+		if leaders == nil {
+			leaders, followers = make(map[string]*coalescedBuild), make(map[string]*coalescedBuild)
+		}
+		leaders[b.leader] = b
+		followers[target] = b
+	}
+	return leaders, followers
+}
+
+// expandedRecipes returns rule's expanded recipes, joined by newlines. If any
+// recipe fails to expand, ok is false.
+func (m *Maker) expandedRecipes(rule Rule) (recipes string, ok bool) {
+	lines := rule.Recipes()
+	if _, planned := rule.(*plannedRule); !planned {
+		lines = m.SelectRecipes(lines)
+	}
+	expanded := make([]string, len(lines))
+	for i, recipe := range lines {
+		var err error
+		if expanded[i], err = m.expandRecipe(rule, recipe); err != nil {
+			return "", false
+		}
+	}
+	return strings.Join(expanded, "\n"), true
+}
+
+// buildCoalesced waits for b's leader to be built and then finishes building
+// rule (a follower), reporting progress and errors like other targets.
+func (m *Maker) buildCoalesced(rule Rule, b *coalescedBuild, prog *progress, par *parallel.Run) {
+	stdout, stderr, log := m.ruleOutput(rule)
+	defer stdout.Close()
+	defer stderr.Close()
+	if m.Started != nil {
+		m.Started <- rule
+	}
+	if m.Hooks != nil {
+		m.Hooks.OnTargetStart(rule.Target())
+	}
+	start := time.Now()
+	defer func() {
+		if m.Ended != nil {
+			m.Ended <- rule
+		}
+	}()
+
+	<-b.done
+	// The leader's recipes may have created, changed, or removed the
+	// outputs.
+	m.invalidateStats(ruleOutputs(rule)...)
+	if m.Verbose {
+		log.Printf("recipes are identical to %s's, so they were only run once", b.leader)
+	}
+	err := b.err
+	if err != nil {
+		err = fmt.Errorf("identical recipes of %s failed: %s", b.leader, err)
+	} else {
+		err = m.checkOutputs(rule, log)
+	}
+	if err == nil && m.ManifestPath != "" {
+		if err = m.recordManifest(rule, b.recipes); err != nil {
+			err = fmt.Errorf("hashing inputs and outputs for manifest failed: %s", err)
+		}
+	}
+	if err != nil {
+		m.removeOutputs(rule, log)
+		log.Print(err)
+		err2 := RuleBuildError{rule, err}
+		m.setFailedStatus(rule.Target())
+		atomic.AddInt32(&prog.failed, 1)
+		if m.Failed != nil {
+			m.Failed <- err2
+		}
+		if m.Hooks != nil {
+			m.Hooks.OnTargetFailure(rule.Target(), err)
+		}
+		par.Error(err2)
+		return
+	}
+
+	m.setStatus(rule.Target(), TargetBuilt)
+	atomic.AddInt32(&prog.done, 1)
+	if m.Succeeded != nil {
+		m.Succeeded <- rule
+	}
+	if m.Hooks != nil {
+		m.Hooks.OnTargetSuccess(rule.Target(), time.Since(start))
+	}
+}
@@ -0,0 +1,67 @@
+package makex
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_coalesceIdenticalRecipes(t *testing.T) {
+	for _, coalesce := range []bool{false, true} {
+		var mu sync.Mutex
+		calls := map[string]int{}
+		conf := &Config{
+			ParallelJobs:             2,
+			FS:                       NewFileSystem(rwvfs.Map(map[string]string{})),
+			CoalesceIdenticalRecipes: coalesce,
+			Builtins: map[string]func(Rule, []string) error{
+				"index": func(_ Rule, args []string) error {
+					mu.Lock()
+					defer mu.Unlock()
+					calls[args[0]]++
+					if args[0] == "bad" {
+						return errors.New("indexing failed")
+					}
+					return nil
+				},
+			},
+		}
+		mf := &Makefile{Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"a", "b", "c", "x", "y"}},
+			&BasicRule{TargetFile: "a", RecipeCmds: []string{"@makex:call index $(DIR)"}},
+			&BasicRule{TargetFile: "b", RecipeCmds: []string{"@makex:call index shared"}},
+			&BasicRule{TargetFile: "c", RecipeCmds: []string{"@makex:call index $@"}},
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{"@makex:call index bad"}},
+			&BasicRule{TargetFile: "y", RecipeCmds: []string{"@makex:call index bad"}},
+		}, Vars: map[string]*Var{"DIR": {Value: "shared"}}}
+		mk := conf.NewMaker(mf, "a", "b", "c", "x", "y")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+
+		err := mk.Run()
+		errs, ok := err.(Errors)
+		if !ok || len(errs) != 2 {
+			t.Fatalf("coalesce=%v: got error %v, want 2 errors", coalesce, err)
+		}
+		want := map[string]int{"shared": 2, "c": 1, "bad": 2}
+		wantYErr := "recipe 1 of 1 for target y failed: @makex:call index bad (indexing failed)"
+		if coalesce {
+			want = map[string]int{"shared": 1, "c": 1, "bad": 1}
+			wantYErr = "identical recipes of x failed: recipe 1 of 1 for target x failed: @makex:call index bad (indexing failed)"
+		}
+		for arg, n := range want {
+			if calls[arg] != n {
+				t.Errorf("coalesce=%v: called index %s %d times, want %d", coalesce, arg, calls[arg], n)
+			}
+		}
+		if e, ok := errs[1].(RuleBuildError); !ok || e.Rule.Target() != "y" || e.Error() != wantYErr {
+			t.Errorf("coalesce=%v: got error %v for y, want %q", coalesce, errs[1], wantYErr)
+		}
+	}
+}
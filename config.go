@@ -2,11 +2,11 @@ package makex
 
 import (
 	"flag"
+	"log"
 	"os"
 	"runtime"
+	"strings"
 	"time"
-
-	"sourcegraph.com/sourcegraph/rwvfs"
 )
 
 type Config struct {
@@ -14,6 +14,281 @@ type Config struct {
 	ParallelJobs int
 	Verbose      bool
 	DryRun       bool
+
+	// Strict makes warnings about likely mistakes in the makefile (such
+	// as a recipe that succeeds without creating its target) into errors.
+	Strict bool
+
+	// KeepGoing makes Run keep building after a target fails (like "make
+	// -k"), skipping only the targets that depend (directly or indirectly)
+	// on a failed target. Run then returns an Errors value with the
+	// errors of all of the targets that failed. The skipped targets are
+	// logged, and their status is TargetPrereqFailed (see
+	// BuildResult.Status).
+	KeepGoing bool
+
+	// RebuildOnMakefileChange makes every target also depend on the
+	// makefile's source files (see Makefile.Sources), so that targets are
+	// rebuilt when the makefile (and perhaps their recipes) changes.
+	RebuildOnMakefileChange bool
+
+	// AtomicTargets makes recipes build each target at a temporary
+	// staging path alongside it: references to the target in the
+	// (expanded) recipes, such as from "$@", are replaced with the
+	// staging path. After the recipes succeed, the staging file is renamed
+	// to the target, so that readers never see a partially built target.
+	// If the recipes fail, the staging file is removed and the existing
+	// target (if any) is left intact. The rename is atomic if FS is a
+	// Renamer (as the default FS is).
+	AtomicTargets bool
+
+	// CoalesceIdenticalRecipes makes Run run identical recipes only once
+	// per target set: if several targets in a target set have the same
+	// recipes (after expansion, which is done an extra time to compare
+	// them), only the first of them (in name order) is built
+	// normally, and the others wait for it. The recipes' output goes to
+	// the first target's writers. If the recipes succeed, the other
+	// targets are checked for missing outputs (see Strict) as usual and
+	// then succeed; if they fail, the other targets fail too, with an
+	// error that names the first target. Services, rules without recipes,
+	// and targets built at a staging path (see AtomicTargets) are never
+	// coalesced, and coalesced targets are omitted from Maker.Timeline.
+	CoalesceIdenticalRecipes bool
+
+	// ManifestPath, if set, is the path (on the local filesystem, not FS)
+	// of a JSON file that Run writes a Manifest of the targets it built
+	// (with the hashes of their inputs and outputs) to after it finishes,
+	// even if the build failed.
+	ManifestPath string
+
+	// DisableStatCache disables the cache of file metadata that Run uses
+	// so that each file is stat'd at most once per build (except after the
+	// targets that produce it are built). The cache can be stale if
+	// recipes change files that aren't their outputs, such as the outputs
+	// of other targets.
+	DisableStatCache bool
+
+	// Restat makes Run compare the contents of each rebuilt target's
+	// outputs before and after its recipes run. If they are unchanged
+	// (as when a generator rewrites an identical file), the target's
+	// dependents are not rebuilt on its account: a dependent that would
+	// otherwise be up to date is skipped, and its mtime is updated (if FS
+	// is a Chtimeser, as the default FS is) so that it isn't considered
+	// stale in later builds either.
+	Restat bool
+
+	// Shell is the command and flags that recipes (and "$(shell ...)"
+	// function calls in recipes) are run with, such as
+	// []string{"bash", "-ec"}; the recipe is appended as the last
+	// argument. If Shell is empty, the makefile's SHELL variable is used
+	// if it is defined (with the flags in its .SHELLFLAGS variable, or, if
+	// that isn't defined, the flag that suits the shell, such as "/C" for
+	// cmd), and DefaultShell() is used otherwise. If Shell is set but its
+	// first element is empty, Run fails before building any targets.
+	Shell []string
+
+	// EnvAllowlist, if non-nil, is the names of the only environment
+	// variables (of the makex process) that recipes are run with, so that
+	// builds don't accidentally depend on the ambient environment. (An
+	// empty, non-nil EnvAllowlist passes no variables.) References in
+	// recipes to other variables that aren't defined in the makefile
+	// expand to nothing, as they would in the recipes' shell. MAKEFLAGS
+	// (see MakeFlags) is always set. Makefiles can't export their
+	// variables to recipes' environment (there is no "export"
+	// directive); use Env to add variables.
+	EnvAllowlist []string
+
+	// Env, if non-nil, is the environment ("NAME=value" strings) that
+	// recipes (and "$(shell ...)" function calls in recipes) are run with
+	// instead of the makex process's environment, for hermetic builds. An
+	// empty, non-nil Env passes no variables; to add variables to the
+	// process's environment rather than replace it, use
+	// append(os.Environ(), "CC=clang"). EnvAllowlist doesn't apply to Env,
+	// and MAKEFLAGS is always set. References in recipes to variables that
+	// aren't defined in the makefile are also expanded using Env (the
+	// makefile's variables take precedence, as they do over the process's
+	// environment).
+	Env []string
+
+	// FakerootCommand, if set, is a command that each recipe's shell
+	// command is run by, such as fakeroot(1), so that recipes believe
+	// that they run as root (for example, to set the ownership of files in
+	// a package) without privileges. Each "{state}" in FakerootCommand is
+	// replaced with the path of a temporary file that is shared by all of
+	// a rule's recipes (and removed after they finish), so that the
+	// recipes of a rule see each other's changes:
+	//
+	//   []string{"fakeroot", "-i", "{state}", "-s", "{state}", "--"}
+	//
+	// Recipes themselves are unchanged. Builtin calls and the last recipe
+	// of a service aren't wrapped.
+	FakerootCommand []string
+
+	// Platform is the "GOOS/GOARCH" platform used to select
+	// platform-tagged recipe lines (see SelectRecipes). If empty, the
+	// current runtime.GOOS and runtime.GOARCH are used.
+	Platform string
+
+	// Builtins are Go functions that recipes can call in-process, without
+	// starting a shell, using a recipe line of the form:
+	//
+	//   @makex:call name arg1 arg2 ...
+	//
+	// The function is called with the rule being built and the
+	// whitespace-separated args (after automatic variable expansion).
+	Builtins map[string]func(rule Rule, args []string) error
+
+	// MaxLoad, if positive, prevents Run from starting a new target while
+	// other targets are running and the system's 1-minute load average is
+	// at least MaxLoad (like GNU make's -l). The load average is available
+	// on Linux, macOS, and the BSDs; on other systems (such as Windows),
+	// MaxLoad is ignored with a warning.
+	MaxLoad float64
+
+	// GracePeriod, if positive, makes Maker.Run handle interrupt signals
+	// (SIGINT and SIGTERM). After the first signal, no new targets are
+	// started, and running recipes are given GracePeriod to finish (and
+	// their targets are kept). After a second signal, or when the grace
+	// period ends, the running recipes are killed and their targets are
+	// removed. Run then returns ErrInterrupted (or the errors of the
+	// targets that failed).
+	//
+	// To keep interrupts (such as Ctrl-C) from reaching the recipes
+	// directly, recipes are run in their own process groups when
+	// GracePeriod is set.
+	GracePeriod time.Duration
+
+	// RecipeTimeout, if positive, is how long each recipe command may run.
+	// A recipe that runs longer is killed (with the processes that it
+	// started, which are in its process group), and its target fails with
+	// a *RecipeError whose Err is a *RecipeTimeoutError, so the target is
+	// removed as usual. If the build is canceled (see Maker.RunContext) or
+	// interrupted first, the recipe is killed for that reason instead.
+	// Builtin calls and the last recipe of a service aren't limited.
+	//
+	// Unless GracePeriod is set, interrupt signals (SIGINT and SIGTERM)
+	// received during the build are forwarded to the recipes' process
+	// groups, and no new targets are started.
+	RecipeTimeout time.Duration
+
+	// BuildRetries is the number of times that Maker.Run retries a build
+	// that failed only with errors that TransientError reports are
+	// transient (such as network errors). TransientError is called with
+	// each RuleBuildError. Only the targets that still need to be built
+	// are rebuilt.
+	BuildRetries   int
+	TransientError func(err error) bool
+
+	// LockGroups, if set, returns the name of the lock group of a rule, or
+	// "" if the rule isn't in a lock group. At most one target in each lock
+	// group is built at a time (for example, because their recipes all
+	// modify the same file), although targets in different lock groups
+	// (or in none) still run in parallel.
+	LockGroups func(r Rule) string
+
+	// MaxTargets and MaxRecipesPerRule, if positive, limit the number of
+	// targets needed to build a Maker's goals and the number of recipe
+	// lines in each of their rules. They guard against makefiles that were
+	// generated incorrectly and are too large to build (see NewMaker).
+	MaxTargets        int
+	MaxRecipesPerRule int
+
+	// AllowTargets and DenyTargets restrict which targets may be built,
+	// using path/filepath.Match glob patterns. If AllowTargets is
+	// non-empty, every target (with a rule) needed to build a Maker's
+	// goals must match one of its patterns, and no such target may match
+	// any of DenyTargets' patterns. Otherwise, the Maker's
+	// TargetSetsNeedingBuild (and therefore Run) returns a
+	// ForbiddenTargetError.
+	AllowTargets, DenyTargets []string
+
+	// MaxEchoLines, if positive, limits the number of a rule's recipe
+	// lines that are logged in verbose mode. The remaining lines are
+	// still run, but are summarized in a single "... (N more lines)"
+	// message.
+	MaxEchoLines int
+
+	// Readiness, if set, is called repeatedly after a service target (see
+	// ServiceRule) is started, until it returns nil to indicate that the
+	// service is ready or ReadinessTimeout elapses. If Readiness is nil,
+	// services are considered ready as soon as they are started.
+	Readiness func(r Rule) error
+
+	// ReadinessTimeout is how long to wait for a service to become ready
+	// (default 30s).
+	ReadinessTimeout time.Duration
+
+	// PerTargetLogDir, if set, is a directory (on the local filesystem,
+	// not FS) in which to write a log file for each target that is built,
+	// named after the target (see TargetLogFile). The log file receives
+	// the target's recipes' stdout and stderr and makex's messages about
+	// the target. The output is also written to the usual writers (see
+	// Maker.RuleOutput) unless PerTargetLogOnly is set.
+	PerTargetLogDir  string
+	PerTargetLogOnly bool
+
+	// PrefixOutput prefixes each line of the recipes' output with
+	// "[target] ", so that it is clear which target wrote it when
+	// targets are built in parallel.
+	PrefixOutput bool
+
+	// GroupOutput buffers the output of each target's recipes (and the
+	// messages logged about the target, such as its errors) until the
+	// target finishes building, whether or not it succeeds, and then
+	// writes it all at once, so that the output of targets built in
+	// parallel isn't interleaved. Services' output isn't grouped. Like
+	// PrefixOutput, it applies to the writers returned by
+	// Maker.RuleOutput (if set), but not to PerTargetLogDir's log files.
+	GroupOutput bool
+
+	// OnOutputLine, if set, is called with each line (without the trailing
+	// newline) that a recipe writes to its stdout or stderr, and stream is
+	// "stdout" or "stderr", respectively. The output is also written to the
+	// rule's usual writers (see Maker.RuleOutput). A final line without a
+	// trailing newline is passed to OnOutputLine when the recipe exits.
+	//
+	// If the rule's stdout and stderr writers are the same (as with
+	// PerTargetLogOnly), recipes write both to the same pipe, which keeps
+	// them in order, so their lines can't be told apart, and stream is
+	// "combined".
+	// Calls to OnOutputLine are never concurrent, even when targets are
+	// built in parallel.
+	OnOutputLine func(r Rule, stream string, line string)
+
+	// OnDiagnostic, if set, is called with each diagnostic (such as a
+	// compiler error) found in the lines that recipes write to their
+	// stdout or stderr by the first of DiagnosticMatchers (or, if it is
+	// nil, DefaultDiagnosticMatchers) that matches the line. Like
+	// OnOutputLine, it is never called concurrently.
+	OnDiagnostic       func(d Diagnostic)
+	DiagnosticMatchers []*DiagnosticMatcher
+
+	// SummaryInterval, if positive, is how often Maker.Run logs (to Log) a
+	// one-line summary of the build's progress, such as:
+	//
+	//   [makex] 42/130 done, 6 running, 0 failed, 3m12s elapsed
+	SummaryInterval time.Duration
+
+	// SlowTargetThreshold, if positive, makes Maker.Run log a warning (to
+	// the target's logger) if a target's recipes are still running after
+	// SlowTargetThreshold, such as:
+	//
+	//   x: x is taking longer than expected (1m0s)
+	//
+	// The target is not stopped. The warning is logged at most once per
+	// target.
+	SlowTargetThreshold time.Duration
+
+	// Nice, if set, returns the niceness (as in nice(1)) at which to run a
+	// rule's recipes, so that less important targets can be kept from
+	// competing for CPU with more important ones. Positive values lower the
+	// recipes' priority; negative values (which usually require elevated
+	// privileges) raise it. Nice is ignored on systems other than Unix.
+	Nice func(r Rule) int
+
+	// Log receives makex's own diagnostic messages (as opposed to recipe
+	// output). If nil, messages are written to os.Stderr.
+	Log *log.Logger
 }
 
 var Default = Config{
@@ -28,7 +303,7 @@ func (c *Config) fs() FileSystem {
 	if err != nil {
 		dir = "."
 	}
-	return NewFileSystem(rwvfs.OS(dir))
+	return NewOSFileSystem(dir)
 }
 
 func (c *Config) pathExists(path string) (bool, error) {
@@ -49,6 +324,23 @@ func (c *Config) modTime(path string) (time.Time, error) {
 	return s.ModTime(), nil
 }
 
+func (c *Config) platform() (goos, goarch string) {
+	if c.Platform == "" {
+		return runtime.GOOS, runtime.GOARCH
+	}
+	if i := strings.Index(c.Platform, "/"); i != -1 {
+		return c.Platform[:i], c.Platform[i+1:]
+	}
+	return c.Platform, ""
+}
+
+func (c *Config) logger() *log.Logger {
+	if c.Log != nil {
+		return c.Log
+	}
+	return log.New(os.Stderr, "", 0)
+}
+
 // Flags adds makex command-line flags to an existing flag.FlagSet (or the
 // global FlagSet if fs is nil).
 func Flags(fs *flag.FlagSet, conf *Config, prefix string) {
@@ -58,4 +350,16 @@ func Flags(fs *flag.FlagSet, conf *Config, prefix string) {
 	fs.BoolVar(&conf.DryRun, prefix+"n", false, "dry run (don't actually run any commands)")
 	fs.IntVar(&conf.ParallelJobs, prefix+"j", runtime.GOMAXPROCS(0), "number of jobs to run in parallel")
 	fs.BoolVar(&conf.Verbose, prefix+"v", false, "verbose")
+	fs.BoolVar(&conf.KeepGoing, prefix+"k", false, "keep going after a target fails, building the targets that don't depend on it")
+	fs.Float64Var(&conf.MaxLoad, prefix+"l", 0, "don't start new jobs if the load average is at least this value (0 means no limit)")
+	fs.BoolVar(&conf.RebuildOnMakefileChange, prefix+"makefile-deps", false, "rebuild targets when the makefile changes")
+	fs.BoolVar(&conf.Restat, prefix+"restat", false, "don't rebuild dependents of targets whose contents are unchanged after rebuilding")
+	fs.DurationVar(&conf.GracePeriod, prefix+"grace-period", 0, "on interrupt, wait this long for running recipes to finish before killing them (0 means don't handle interrupts)")
+	fs.DurationVar(&conf.RecipeTimeout, prefix+"recipe-timeout", 0, "kill recipe commands that run longer than this (0 means no limit)")
+	fs.DurationVar(&conf.SummaryInterval, prefix+"summary-interval", 0, "log a one-line progress summary this often (0 means never)")
+	fs.DurationVar(&conf.SlowTargetThreshold, prefix+"slow-target-threshold", 0, "warn about targets that take longer than this to build (0 means never)")
+	fs.StringVar(&conf.ManifestPath, prefix+"manifest", "", "write a JSON manifest of the built targets' inputs and outputs (with hashes) to this file")
+	fs.StringVar(&conf.PerTargetLogDir, prefix+"log-dir", "", "also write each target's output to a log file in this directory")
+	fs.BoolVar(&conf.PrefixOutput, prefix+"prefix-output", false, "prefix each line of the recipes' output with [target]")
+	fs.BoolVar(&conf.GroupOutput, prefix+"group-output", false, "write each target's output all at once when it finishes, so that parallel targets' output isn't interleaved")
 }
@@ -0,0 +1,92 @@
+package makex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ResolvedVariables returns the fully expanded value of each of the makefile's
+// variables, which is what a recipe that referenced the variable would see.
+// Expanding a variable may run commands (in "$(shell ...)" function calls).
+// Variables whose expansion fails are omitted; WriteDatabase shows their
+// errors.
+func (m *Maker) ResolvedVariables() map[string]string {
+	vars := make(map[string]string, len(m.mf.Vars))
+	for name := range m.mf.Vars {
+		if v, err := m.mf.newExpander().lookup(name); err == nil {
+			vars[name] = v
+		}
+	}
+	return vars
+}
+
+// WriteDatabase writes a description of the makefile's variables and rules to
+// w, similar to the output of "make -p". Each variable is shown as it was
+// defined and with its expanded value (see ResolvedVariables), and each rule
+// is shown with its recipes and whether it is phony, a service, or stale.
+func (m *Maker) WriteDatabase(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "# Variables")
+	for _, name := range sortedVarNames(m.mf.Vars) {
+		v := m.mf.Vars[name]
+		fmt.Fprintln(bw)
+		if v.Simple {
+			fmt.Fprintln(bw, "# makefile (simply expanded)")
+			fmt.Fprintf(bw, "%s := %s\n", name, v.Value)
+			continue
+		}
+		fmt.Fprintln(bw, "# makefile (recursively expanded)")
+		if value, err := m.mf.newExpander().lookup(name); err != nil {
+			fmt.Fprintf(bw, "#  error expanding: %s\n", err)
+		} else {
+			fmt.Fprintf(bw, "#  expands to: %s\n", value)
+		}
+		fmt.Fprintf(bw, "%s = %s\n", name, v.Value)
+	}
+
+	fmt.Fprintln(bw)
+	fmt.Fprintln(bw, "# Files")
+	for _, rule := range m.mf.Rules {
+		target := rule.Target()
+		fmt.Fprintln(bw)
+		fmt.Fprintf(bw, "%s: %s\n", Quote(target), strings.Join(QuoteList(rule.Prereqs()), " "))
+		switch {
+		case isPhony(m, target):
+			fmt.Fprintln(bw, "#  Phony target (prerequisite of .PHONY).")
+		case isService(rule):
+			fmt.Fprintln(bw, "#  Service target.")
+		}
+		if isRunOnce(rule) {
+			fmt.Fprintln(bw, "#  Recipes run at most once per build.")
+		}
+		if outputs := ruleOutputs(rule)[1:]; len(outputs) > 0 {
+			fmt.Fprintf(bw, "#  Also produces: %s\n", strings.Join(QuoteList(outputs), " "))
+		}
+		if inputs := staleInputs(rule); len(inputs) > 0 {
+			fmt.Fprintf(bw, "#  Stale inputs: %s\n", strings.Join(QuoteList(inputs), " "))
+		}
+		if tags := ruleTags(rule); len(tags) > 0 {
+			fmt.Fprintf(bw, "#  Tags: %s\n", strings.Join(tags, ", "))
+		}
+		if _, inDAG := m.rules[target]; inDAG && !strings.HasPrefix(target, ".") {
+			if stale, reason, err := m.staleness(target); err != nil {
+				fmt.Fprintf(bw, "#  error checking whether target needs to be built: %s\n", err)
+			} else if stale {
+				fmt.Fprintf(bw, "#  Needs to be built: %s.\n", reason)
+			} else {
+				fmt.Fprintf(bw, "#  Up to date: %s.\n", reason)
+			}
+		}
+		if recipes := rule.Recipes(); len(recipes) > 0 {
+			fmt.Fprintln(bw, "#  recipe to execute:")
+			for _, recipe := range recipes {
+				fmt.Fprintf(bw, "\t%s\n", recipe)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,73 @@
+package makex
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_ResolvedVariables(t *testing.T) {
+	mf, err := Parse([]byte(`
+CC = gcc
+CFLAGS = $(OPT) -Wall
+OPT := -O2
+LOOP = $(LOOP)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := (&Config{}).NewMaker(mf)
+	want := map[string]string{"CC": "gcc", "CFLAGS": "-O2 -Wall", "OPT": "-O2"}
+	if got := mk.ResolvedVariables(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMaker_WriteDatabase(t *testing.T) {
+	mf, err := Parse([]byte(`
+CC = gcc
+OPT := -O2
+
+.PHONY: all
+all: x
+x: x.c
+	$(CC) $(OPT) -o $@ x.c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{"x.c": ""}))}
+	mk := conf.NewMaker(mf, "all")
+
+	var buf bytes.Buffer
+	if err := mk.WriteDatabase(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# Variables
+
+# makefile (recursively expanded)
+#  expands to: gcc
+CC = gcc
+
+# makefile (simply expanded)
+OPT := -O2
+
+# Files
+
+.PHONY: all
+
+all: x
+#  Phony target (prerequisite of .PHONY).
+#  Needs to be built: all is phony, so it is always built.
+
+x: x.c
+#  Needs to be built: x does not exist.
+#  recipe to execute:
+	$(CC) $(OPT) -o x x.c
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got database\n%s\nwant\n%s", got, want)
+	}
+}
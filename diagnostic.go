@@ -0,0 +1,101 @@
+package makex
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// A Diagnostic is an error or warning message (such as a compiler error)
+// that a recipe printed, extracted from the recipe's output by a
+// DiagnosticMatcher.
+type Diagnostic struct {
+	// Target is the target whose recipe printed the diagnostic.
+	Target string
+
+	// File, Line, and Col are the position that the diagnostic refers
+	// to. Line and Col are 1-based, or 0 if unknown.
+	File      string
+	Line, Col int
+
+	// Severity is the kind of diagnostic, such as "error", "warning", or
+	// "note".
+	Severity string
+
+	Message string
+}
+
+// A DiagnosticMatcher extracts Diagnostics from lines of recipe output (see
+// Config.OnDiagnostic) using a regular expression.
+type DiagnosticMatcher struct {
+	// Regexp matches a line that is a diagnostic. Its named groups
+	// "file", "line", "col", "severity", and "message" (all optional)
+	// give the corresponding Diagnostic fields.
+	Regexp *regexp.Regexp
+
+	// Severity is the severity of diagnostics whose line doesn't have a
+	// "severity" group (or has an empty one).
+	Severity string
+}
+
+var (
+	// GCCDiagnostics matches GCC and Clang diagnostics, such as
+	// "x.c:3:5: error: unknown type name 'foo'".
+	GCCDiagnostics = &DiagnosticMatcher{
+		Regexp:   regexp.MustCompile(`^(?P<file>[^:\s][^:]*):(?P<line>\d+):(?:(?P<col>\d+):)? (?P<severity>fatal error|error|warning|note): (?P<message>.*)$`),
+		Severity: "error",
+	}
+
+	// GoDiagnostics matches errors from the go command's build and vet
+	// tools, such as "./x.go:3:5: undefined: foo".
+	GoDiagnostics = &DiagnosticMatcher{
+		Regexp:   regexp.MustCompile(`^(?P<file>[^:\s][^:]*\.go):(?P<line>\d+)(?::(?P<col>\d+))?: (?P<message>.*)$`),
+		Severity: "error",
+	}
+)
+
+// DefaultDiagnosticMatchers are the matchers used when
+// Config.DiagnosticMatchers is nil.
+var DefaultDiagnosticMatchers = []*DiagnosticMatcher{GCCDiagnostics, GoDiagnostics}
+
+// Match returns the diagnostic that line describes, if it matches dm.
+func (dm *DiagnosticMatcher) Match(line string) (Diagnostic, bool) {
+	m := dm.Regexp.FindStringSubmatch(line)
+	if m == nil {
+		return Diagnostic{}, false
+	}
+	d := Diagnostic{Severity: dm.Severity}
+	for i, name := range dm.Regexp.SubexpNames() {
+		if m[i] == "" {
+			continue
+		}
+		switch name {
+		case "file":
+			d.File = m[i]
+		case "line":
+			d.Line, _ = strconv.Atoi(m[i])
+		case "col":
+			d.Col, _ = strconv.Atoi(m[i])
+		case "severity":
+			d.Severity = m[i]
+		case "message":
+			d.Message = m[i]
+		}
+	}
+	return d, true
+}
+
+// diagnostic returns the diagnostic that a line of rule's recipes' output
+// describes, using the first of the configured matchers that matches it.
+func (m *Maker) diagnostic(rule Rule, line string) (Diagnostic, bool) {
+	matchers := m.DiagnosticMatchers
+	if matchers == nil {
+		matchers = DefaultDiagnosticMatchers
+	}
+	for _, dm := range matchers {
+		if d, ok := dm.Match(line); ok {
+			d.Target = rule.Target()
+			return d, true
+		}
+	}
+	return Diagnostic{}, false
+}
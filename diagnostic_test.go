@@ -0,0 +1,96 @@
+package makex
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestDiagnosticMatchers(t *testing.T) {
+	tests := map[string]struct {
+		matcher *DiagnosticMatcher
+		want    *Diagnostic
+	}{
+		"x.c:3:5: error: unknown type name 'foo'": {
+			matcher: GCCDiagnostics,
+			want:    &Diagnostic{File: "x.c", Line: 3, Col: 5, Severity: "error", Message: "unknown type name 'foo'"},
+		},
+		"src/y.h:10: warning: unused variable": {
+			matcher: GCCDiagnostics,
+			want:    &Diagnostic{File: "src/y.h", Line: 10, Severity: "warning", Message: "unused variable"},
+		},
+		"x.c:1:1: fatal error: z.h: No such file or directory": {
+			matcher: GCCDiagnostics,
+			want:    &Diagnostic{File: "x.c", Line: 1, Col: 1, Severity: "fatal error", Message: "z.h: No such file or directory"},
+		},
+		"./main.go:7:2: undefined: foo": {
+			matcher: GoDiagnostics,
+			want:    &Diagnostic{File: "./main.go", Line: 7, Col: 2, Severity: "error", Message: "undefined: foo"},
+		},
+		"pkg/x.go:12: missing return": {
+			matcher: GoDiagnostics,
+			want:    &Diagnostic{File: "pkg/x.go", Line: 12, Severity: "error", Message: "missing return"},
+		},
+		"cc -c x.c":         {matcher: GCCDiagnostics},
+		"# example.com/p":   {matcher: GoDiagnostics},
+		"x.c:3:5: error: x": {matcher: GoDiagnostics},
+	}
+	for line, test := range tests {
+		d, ok := test.matcher.Match(line)
+		if test.want == nil {
+			if ok {
+				t.Errorf("%q: got diagnostic %+v, want no match", line, d)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%q: got no match, want %+v", line, *test.want)
+			continue
+		}
+		if d != *test.want {
+			t.Errorf("%q: got diagnostic %+v, want %+v", line, d, *test.want)
+		}
+	}
+}
+
+func TestMaker_Run_onDiagnostic(t *testing.T) {
+	var diags []Diagnostic
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		OnDiagnostic: func(d Diagnostic) { diags = append(diags, d) },
+		DiagnosticMatchers: []*DiagnosticMatcher{
+			{Regexp: regexp.MustCompile(`^lint: (?P<file>\S+) line (?P<line>\d+): (?P<message>.*)$`), Severity: "warning"},
+			GCCDiagnostics,
+		},
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{
+				"echo compiling; echo 'x.c:2:1: error: expected expression' >&2",
+				"printf 'lint: x.c line 4: too long'",
+			}},
+		},
+	}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Diagnostic{
+		{Target: "x", File: "x.c", Line: 2, Col: 1, Severity: "error", Message: "expected expression"},
+		{Target: "x", File: "x.c", Line: 4, Severity: "warning", Message: "too long"},
+	}
+	if !reflect.DeepEqual(diags, want) {
+		t.Errorf("got diagnostics %+v, want %+v", diags, want)
+	}
+}
@@ -0,0 +1,482 @@
+package makex
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// A Var is a makefile variable.
+type Var struct {
+	// Value is the variable's value. If Simple is false, it is expanded
+	// each time the variable is referenced; otherwise, it was already
+	// expanded when the variable was defined.
+	Value string
+
+	// Simple is whether the variable is simply expanded (defined with
+	// ":=") rather than recursively expanded (defined with "=").
+	Simple bool
+
+	// referenced is whether the variable was referenced while parsing
+	// the makefile (in a target, prereq, or simply expanded variable),
+	// since those references are expanded away. It is used by
+	// LintUnusedVars.
+	referenced bool
+}
+
+// An expander expands variable references (such as "$(CC)" and "$X") and
+// function calls (such as "$(shell date)") in makefile text. References to
+// variables that aren't defined in the makefile are expanded using the
+// environment.
+//
+// The automatic variables $@, $^, and $< are left as is, because they are
+// expanded separately (see ExpandAutoVars).
+type expander struct {
+	vars map[string]*Var
+
+	// locals are variables (such as the values captured by a template
+	// rule's placeholders) that take precedence over vars.
+	locals map[string]string
+
+	// shell runs cmd for the $(shell ...) function and returns its
+	// output.
+	shell func(cmd string) ([]byte, error)
+
+	// lookupEnv looks up variables that aren't defined in the makefile. If
+	// nil, os.LookupEnv is used.
+	lookupEnv func(name string) (string, bool)
+
+	// strict makes references to undefined variables (that aren't in the
+	// environment either) and calls to unknown functions errors.
+	strict bool
+
+	// markReferenced is whether to mark variables as referenced when they
+	// are looked up (see Var.referenced).
+	markReferenced bool
+
+	// expanding is the set of recursively expanded variables that are
+	// currently being expanded, which is used to detect variables that
+	// reference themselves.
+	expanding map[string]bool
+}
+
+func (mf *Makefile) newExpander() *expander {
+	return &expander{
+		vars:      mf.Vars,
+		shell:     defaultShell,
+		expanding: make(map[string]bool),
+	}
+}
+
+// defaultShell runs cmd in DefaultShell, for "$(shell ...)" function calls
+// and "!=" assignments in the makefile.
+func defaultShell(cmd string) ([]byte, error) {
+	sh := DefaultShell()
+	return exec.Command(sh[0], append(sh[1:], cmd)...).Output()
+}
+
+// noShell is a shell that doesn't run cmd (see ParseOnly).
+func noShell(cmd string) ([]byte, error) { return nil, nil }
+
+// expandRecipe expands the automatic variables, makefile variables, and
+// function calls in one of rule's recipes. In addition to the automatic
+// variables expanded by ExpandAutoVars, "$(@TMP)" expands to the rule's
+// TempFile. The recipes of rules in a Plan are already expanded.
+//
+// Only the automatic variables (including "$(@TMP)" and, in the recipes of
+// pattern rules, "$*") are expanded if the makefile wasn't parsed and has no
+// Vars (see Makefile.Vars), so that the recipes of rules constructed in Go are
+// otherwise passed to the shell as is.
+func (m *Maker) expandRecipe(rule Rule, recipe string) (string, error) {
+	if _, planned := rule.(*plannedRule); planned {
+		return recipe, nil
+	}
+	recipe = ExpandAutoVars(rule, recipe)
+	if !m.mf.expandsVars() {
+		if r, ok := rule.(*templateRule); ok {
+			if stem, ok := r.vars["*"]; ok {
+				recipe = strings.Replace(recipe, "$*", stem, -1)
+			}
+		}
+		return strings.Replace(recipe, "$(@TMP)", Quote(TempFile(rule)), -1), nil
+	}
+	return m.recipeExpander(rule).expand(recipe)
+}
+
+// recipeExpander returns an expander for rule's recipes.
+func (m *Maker) recipeExpander(rule Rule) *expander {
+	x := m.mf.newExpander()
+	x.shell = m.runShell
+	if m.Env != nil || m.EnvAllowlist != nil {
+		x.lookupEnv = lookupEnv(m.recipeEnv())
+	}
+	x.locals = map[string]string{"@TMP": Quote(TempFile(rule))}
+	if r, ok := rule.(*templateRule); ok {
+		for name, v := range r.vars {
+			x.locals[name] = v
+		}
+	}
+	return x
+}
+
+// expand returns s with all variable references and function calls
+// expanded, and with "$$" replaced by "$".
+func (x *expander) expand(s string) (string, error) {
+	if strings.IndexByte(s, '$') == -1 {
+		return s, nil
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case '$':
+			b.WriteByte('$')
+		case '@', '<', '^':
+			b.WriteByte('$')
+			b.WriteByte(c)
+		case '(', '{':
+			end := closingDelim(s, i)
+			if end == -1 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			v, err := x.expandRef(s[i+1 : end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i = end
+		default:
+			v, err := x.lookup(string(c))
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+		}
+	}
+	return b.String(), nil
+}
+
+// closingDelim returns the index of the ')' or '}' that closes the '(' or '{'
+// at s[open], or -1 if there is none.
+func closingDelim(s string, open int) int {
+	openc, closec := s[open], byte(')')
+	if openc == '{' {
+		closec = '}'
+	}
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case openc:
+			depth++
+		case closec:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expandRef expands the text inside a "$(...)" or "${...}": either a function
+// call or a variable reference (possibly a substitution reference like
+// "$(SRCS:.c=.o)").
+func (x *expander) expandRef(ref string) (string, error) {
+	if i := strings.IndexAny(ref, " \t"); i != -1 {
+		if f, ok := makeFuncs[ref[:i]]; ok {
+			args := splitFuncArgs(strings.TrimLeft(ref[i+1:], " \t"), f.nargs)
+			return f.call(x, args)
+		}
+	}
+
+	name, err := x.expand(ref)
+	if err != nil {
+		return "", err
+	}
+	if colon := strings.IndexByte(name, ':'); colon != -1 {
+		if eq := strings.IndexByte(name[colon:], '='); eq != -1 {
+			from, to := name[colon+1:colon+eq], name[colon+eq+1:]
+			v, err := x.lookup(name[:colon])
+			if err != nil {
+				return "", err
+			}
+			return substRef(v, from, to), nil
+		}
+	}
+	if i := strings.IndexAny(name, " \t"); i != -1 && x.strict {
+		return "", fmt.Errorf("unknown function %q", name[:i])
+	}
+	return x.lookup(name)
+}
+
+// lookup returns the expanded value of the named variable.
+func (x *expander) lookup(name string) (string, error) {
+	if v, present := x.locals[name]; present {
+		return v, nil
+	}
+	v, present := x.vars[name]
+	if !present {
+		lookupEnv := os.LookupEnv
+		if x.lookupEnv != nil {
+			lookupEnv = x.lookupEnv
+		}
+		if v, inEnv := lookupEnv(name); inEnv || !x.strict {
+			return v, nil
+		}
+		return "", fmt.Errorf("undefined variable %q", name)
+	}
+	if x.markReferenced {
+		v.referenced = true
+	}
+	if v.Simple {
+		return v.Value, nil
+	}
+	if x.expanding[name] {
+		return "", fmt.Errorf("recursive variable %q references itself", name)
+	}
+	x.expanding[name] = true
+	defer delete(x.expanding, name)
+	return x.expand(v.Value)
+}
+
+// substRef replaces the suffix from with to in each whitespace-separated word
+// of s, as in the substitution reference "$(VAR:from=to)".
+func substRef(s, from, to string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		if strings.HasSuffix(w, from) {
+			words[i] = w[:len(w)-len(from)] + to
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// A makeFunc is a function that can be called from makefile text, as in
+// "$(name arg1,arg2)".
+type makeFunc struct {
+	// nargs is the maximum number of comma-separated args, or 0 if
+	// there is no maximum. Commas after the last arg are part of the last
+	// arg.
+	nargs int
+
+	// call calls the function with its unexpanded args.
+	call func(x *expander, args []string) (string, error)
+}
+
+var makeFuncs map[string]makeFunc
+
+func init() {
+	makeFuncs = map[string]makeFunc{
+		"shell":   {1, (*expander).callShell},
+		"foreach": {3, (*expander).callForeach},
+		"if":      {3, (*expander).callIf},
+		"or":      {0, (*expander).callOr},
+		"and":     {0, (*expander).callAnd},
+	}
+}
+
+// callShell implements "$(shell cmd)", which runs cmd and expands to its
+// output with newlines converted to spaces (and trailing newlines removed).
+// Like GNU make, it ignores the command's exit status.
+func (x *expander) callShell(args []string) (string, error) {
+	cmd, err := x.expand(args[0])
+	if err != nil {
+		return "", err
+	}
+	out, err := x.shell(cmd)
+	if _, isExitErr := err.(*exec.ExitError); err != nil && !isExitErr {
+		return "", err
+	}
+	return strings.Replace(strings.TrimRight(string(out), "\n"), "\n", " ", -1), nil
+}
+
+// callForeach implements "$(foreach var,list,text)", which expands text once
+// for each whitespace-separated word in list, with the variable var set to the
+// word, and joins the results with spaces. The variable's previous value (if
+// any) is restored afterwards.
+func (x *expander) callForeach(args []string) (string, error) {
+	if len(args) != 3 {
+		return "", fmt.Errorf("foreach: got %d args, want 3", len(args))
+	}
+	name, err := x.expand(strings.TrimSpace(args[0]))
+	if err != nil {
+		return "", err
+	}
+	list, err := x.expand(args[1])
+	if err != nil {
+		return "", err
+	}
+
+	if x.locals == nil {
+		x.locals = make(map[string]string)
+	}
+	prev, hadPrev := x.locals[name]
+	defer func() {
+		if hadPrev {
+			x.locals[name] = prev
+		} else {
+			delete(x.locals, name)
+		}
+	}()
+
+	words := strings.Fields(list)
+	results := make([]string, 0, len(words))
+	for _, w := range words {
+		x.locals[name] = w
+		v, err := x.expand(args[2])
+		if err != nil {
+			return "", err
+		}
+		results = append(results, v)
+	}
+	return strings.Join(results, " "), nil
+}
+
+// callIf implements "$(if cond,then[,else])", which expands to then if cond
+// (with leading and trailing whitespace removed) expands to a non-empty
+// string, and to else otherwise. Only the chosen branch is expanded.
+func (x *expander) callIf(args []string) (string, error) {
+	if len(args) < 2 {
+		return "", fmt.Errorf("if: got %d args, want 2 or 3", len(args))
+	}
+	cond, err := x.expand(strings.TrimSpace(args[0]))
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(cond) != "" {
+		return x.expand(args[1])
+	}
+	if len(args) == 3 {
+		return x.expand(args[2])
+	}
+	return "", nil
+}
+
+// callOr implements "$(or cond1[,cond2...])", which expands to the first
+// arg that expands to a non-empty string (or to the empty string if none
+// do). The args after that one are not expanded.
+func (x *expander) callOr(args []string) (string, error) {
+	for _, arg := range args {
+		v, err := x.expand(arg)
+		if err != nil {
+			return "", err
+		}
+		if v != "" {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// callAnd implements "$(and cond1[,cond2...])", which expands to the empty
+// string if any arg expands to the empty string (without expanding the args
+// after it), and otherwise to the last arg's expansion.
+func (x *expander) callAnd(args []string) (string, error) {
+	var v string
+	for _, arg := range args {
+		var err error
+		if v, err = x.expand(arg); err != nil {
+			return "", err
+		}
+		if v == "" {
+			return "", nil
+		}
+	}
+	return v, nil
+}
+
+// splitFuncArgs splits s into at most n (or, if n is 0, any number of)
+// comma-separated args, ignoring commas inside parentheses or braces.
+func splitFuncArgs(s string, n int) []string {
+	var args []string
+	depth, start := 0, 0
+	for i := 0; i < len(s) && (n == 0 || len(args) < n-1); i++ {
+		switch s[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, s[start:])
+}
+
+// assign defines the variable name using the assignment operator op ("=",
+// ":=", "::=", "?=", "+=", or "!=") and the unexpanded value. The shell func
+// runs the commands in "!=" assignments and "$(shell ...)" calls.
+func (mf *Makefile) assign(name, op, value string, shell func(cmd string) ([]byte, error)) error {
+	if mf.Vars == nil {
+		mf.Vars = make(map[string]*Var)
+	}
+	newExpander := func() *expander {
+		x := mf.newExpander()
+		x.shell = shell
+		x.markReferenced = true
+		return x
+	}
+	if v, present := mf.Vars[name]; present && v.referenced {
+		defer func() { mf.Vars[name].referenced = true }()
+	}
+	switch op {
+	case "=":
+		mf.Vars[name] = &Var{Value: value}
+	case ":=", "::=":
+		v, err := newExpander().expand(value)
+		if err != nil {
+			return err
+		}
+		mf.Vars[name] = &Var{Value: v, Simple: true}
+	case "?=":
+		if _, present := mf.Vars[name]; !present {
+			mf.Vars[name] = &Var{Value: value}
+		}
+	case "+=":
+		v, present := mf.Vars[name]
+		if !present {
+			mf.Vars[name] = &Var{Value: value}
+			break
+		}
+		if v.Simple {
+			var err error
+			if value, err = newExpander().expand(value); err != nil {
+				return err
+			}
+		}
+		if v.Value != "" {
+			value = v.Value + " " + value
+		}
+		mf.Vars[name] = &Var{Value: value, Simple: v.Simple}
+	case "!=":
+		out, err := newExpander().callShell([]string{value})
+		if err != nil {
+			return err
+		}
+		mf.Vars[name] = &Var{Value: out, Simple: true}
+	default:
+		return fmt.Errorf("unknown assignment operator %q", op)
+	}
+	return nil
+}
+
+// sortedVarNames returns the names of vars in sorted order.
+func sortedVarNames(vars map[string]*Var) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
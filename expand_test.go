@@ -0,0 +1,130 @@
+package makex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestExpander_expand(t *testing.T) {
+	vars := map[string]*Var{
+		"A":    {Value: "a"},
+		"AB":   {Value: "$(A)b"},
+		"N":    {Value: "A"},
+		"SRCS": {Value: "x.c y.c z.h"},
+		"S":    {Value: "$$(A)", Simple: true},
+		"SELF": {Value: "$(SELF)"},
+		"X":    {Value: "x"},
+	}
+	tests := map[string]struct {
+		want    string
+		wantErr bool
+	}{
+		"":                  {want: ""},
+		"no vars":           {want: "no vars"},
+		"$(A) ${A} $X":      {want: "a a x"},
+		"$(AB)":             {want: "ab"},
+		"$($(N))":           {want: "a"},
+		"$(SRCS:.c=.o)":     {want: "x.o y.o z.h"},
+		"$(S)":              {want: "$$(A)"},
+		"$$(A) $$HOME":      {want: "$(A) $HOME"},
+		"$@ $< $^":          {want: "$@ $< $^"},
+		"$(UNDEFINED_VAR_)": {want: ""},
+		"$(shell echo hi)":  {want: "hi"},
+		"$(SELF)":           {wantErr: true},
+		"$(A":               {wantErr: true},
+
+		"$(foreach f,$(SRCS),<$(f)>)":                      {want: "<x.c> <y.c> <z.h>"},
+		"$(foreach v,1 2,$(foreach w,a b,$(v)$(w)))":       {want: "1a 1b 2a 2b"},
+		"$(foreach X,1 2,$(X)) $(X)":                       {want: "1 2 x"},
+		"$(foreach f,$(SRCS),$(if $(f:.h=),$(f:.c=.o)))":   {want: "x.o y.o z.h"},
+		"$(if $(A),yes,no) $(if $(UNDEFINED_VAR_),yes,no)": {want: "yes no"},
+		"$(if  ,yes)":                          {want: ""},
+		"$(if $(A),$(foreach v,1 2,$(A)$(v)))": {want: "a1 a2"},
+		"$(if $(A),ok,$(SELF))":                {want: "ok"},
+		"$(or $(UNDEFINED_VAR_),$(A),$(SELF))": {want: "a"},
+		"$(or $(UNDEFINED_VAR_),)":             {want: ""},
+		"$(and $(A),$(X))":                     {want: "x"},
+		"$(and $(UNDEFINED_VAR_),$(SELF))":     {want: ""},
+		"$(foreach f,x,$(SELF))":               {wantErr: true},
+	}
+	for input, test := range tests {
+		x := (&Makefile{Vars: vars}).newExpander()
+		got, err := x.expand(input)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: got no error, want error", input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: expand: %s", input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", input, got, test.want)
+		}
+	}
+}
+
+func TestMaker_Run_lazyShell(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mf, err := Parse([]byte(fmt.Sprintf(`
+UNUSED = $(shell touch %[1]s/unused)
+USED = $(shell touch %[1]s/used)
+all:
+	true $(USED)
+other:
+	true $(UNUSED)
+`, filepath.ToSlash(tmpDir))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{ParallelJobs: 1, FS: NewFileSystem(rwvfs.OS(tmpDir))}
+	if isFile(conf.FS, "used") || isFile(conf.FS, "unused") {
+		t.Fatal("$(shell) in recursive variable ran during Parse")
+	}
+	if err := conf.NewMaker(mf, "all").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !isFile(conf.FS, "used") {
+		t.Error("$(shell) in variable referenced by built target's recipe did not run")
+	}
+	if isFile(conf.FS, "unused") {
+		t.Error("$(shell) in variable referenced only by unbuilt target's recipe ran")
+	}
+}
+
+func TestMaker_Run_shellSyntaxInBasicRule(t *testing.T) {
+	var out bytes.Buffer
+	conf := &Config{ParallelJobs: 1, FS: NewFileSystem(rwvfs.Map(map[string]string{}))}
+	// The makefile wasn't parsed, so only the automatic variables in its
+	// recipes are expanded, and the shell sees the rest as is.
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{`v=$(echo sub); for f in a b; do printf "%s-$f," "$v"; done; echo $@ ${v}`}},
+	}}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{&out}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "sub-a,sub-b,x sub\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,38 @@
+package makex
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// fakerootStatePlaceholder is replaced in Config.FakerootCommand with the path
+// of the state file that is shared by a rule's recipes.
+const fakerootStatePlaceholder = "{state}"
+
+// fakerootWrapper returns the command (see Config.FakerootCommand) that
+// rule's recipes are run with, with each "{state}" replaced by the path of a
+// new, empty temporary state file. Calling cleanup removes the state file.
+func (m *Maker) fakerootWrapper() (wrapper []string, cleanup func(), err error) {
+	wrapper = make([]string, len(m.FakerootCommand))
+	copy(wrapper, m.FakerootCommand)
+	cleanup = func() {}
+
+	var state string
+	for i, arg := range wrapper {
+		if !strings.Contains(arg, fakerootStatePlaceholder) {
+			continue
+		}
+		if state == "" {
+			f, err := ioutil.TempFile("", "makex-fakeroot-")
+			if err != nil {
+				return nil, nil, err
+			}
+			f.Close()
+			state = f.Name()
+			cleanup = func() { os.Remove(state) }
+		}
+		wrapper[i] = strings.Replace(arg, fakerootStatePlaceholder, state, -1)
+	}
+	return wrapper, cleanup, nil
+}
@@ -0,0 +1,59 @@
+package makex
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_fakerootCommand(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	wrapperLog := filepath.Join(tmpDir, "wrapper.log")
+
+	// The fake fakeroot logs its state file's path (which the shell
+	// receives as $0) and whether it exists, and then runs the recipe's
+	// shell.
+	var out bytes.Buffer
+	conf := &Config{
+		ParallelJobs:    1,
+		FS:              NewFileSystem(rwvfs.Map(map[string]string{})),
+		FakerootCommand: []string{"sh", "-c", `test -f "$0" && echo "$0" >> '` + wrapperLog + `'; exec "$@"`, "{state}"},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"echo building $@", "echo done"}},
+	}}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{&out}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "building x\ndone\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+	data, err := ioutil.ReadFile(wrapperLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := strings.Fields(string(data))
+	if len(states) != 2 || states[0] != states[1] {
+		t.Fatalf("got state files %v, want the same state file for both recipes", states)
+	}
+	if _, err := os.Stat(states[0]); !os.IsNotExist(err) {
+		t.Errorf("got Stat error %v for state file after build, want it to not exist", err)
+	}
+}
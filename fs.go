@@ -1,7 +1,10 @@
 package makex
 
 import (
+	"io"
+	"os"
 	"path/filepath"
+	"time"
 
 	"sourcegraph.com/sourcegraph/rwvfs"
 )
@@ -23,3 +26,59 @@ func NewFileSystem(fs rwvfs.FileSystem) FileSystem {
 type walkableRWVFS struct{ rwvfs.FileSystem }
 
 func (_ walkableRWVFS) Join(elem ...string) string { return filepath.Join(elem...) }
+
+// NewOSFileSystem returns a FileSystem for the OS filesystem tree rooted at
+// dir. Unlike NewFileSystem(rwvfs.OS(dir)), it is a Renamer and a Chtimeser.
+func NewOSFileSystem(dir string) FileSystem {
+	return osFileSystem{walkableRWVFS{rwvfs.OS(dir)}, dir}
+}
+
+type osFileSystem struct {
+	walkableRWVFS
+	root string
+}
+
+func (fs osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(filepath.Join(fs.root, oldpath), filepath.Join(fs.root, newpath))
+}
+
+func (fs osFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(fs.root, name), atime, mtime)
+}
+
+// A Renamer is a FileSystem that can atomically rename files, replacing the
+// file at newpath if it exists. It is used by Config.AtomicTargets.
+type Renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// A Chtimeser is a FileSystem that can change files' access and modification
+// times. It is used by Config.Restat.
+type Chtimeser interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// rename renames oldpath to newpath in fs. If fs isn't a Renamer, the file is
+// copied and then removed, which isn't atomic.
+func rename(fs FileSystem, oldpath, newpath string) error {
+	if r, ok := fs.(Renamer); ok {
+		return r.Rename(oldpath, newpath)
+	}
+	src, err := fs.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.Create(newpath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.Remove(oldpath)
+}
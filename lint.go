@@ -0,0 +1,164 @@
+package makex
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A LintRule inspects a makefile and returns the issues it finds.
+type LintRule func(mf *Makefile) []LintIssue
+
+// A LintIssue is a likely mistake or violation of a convention in a makefile,
+// found by a LintRule.
+type LintIssue struct {
+	// Target is the target of the rule that the issue concerns, if any.
+	Target string
+
+	// Var is the name of the variable that the issue concerns, if any.
+	Var string
+
+	Message string
+}
+
+func (i LintIssue) String() string {
+	switch {
+	case i.Target != "":
+		return fmt.Sprintf("%s: %s", i.Target, i.Message)
+	case i.Var != "":
+		return fmt.Sprintf("variable %s: %s", i.Var, i.Message)
+	}
+	return i.Message
+}
+
+// DefaultLintRules are the lint rules used by the makex command's -lint flag.
+var DefaultLintRules = []LintRule{
+	LintUnusedVars,
+	LintNoRecipes,
+	LintPhonyFiles,
+	LintLongRecipes(20),
+}
+
+// Lint runs each of the lint rules on mf and returns all of the issues they
+// found, in order.
+func (mf *Makefile) Lint(rules []LintRule) []LintIssue {
+	var issues []LintIssue
+	for _, rule := range rules {
+		issues = append(issues, rule(mf)...)
+	}
+	return issues
+}
+
+// LintUnusedVars reports variables that are never referenced by a target,
+// prereq, recipe, or other variable.
+func LintUnusedVars(mf *Makefile) []LintIssue {
+	used := map[string]bool{}
+	for _, rule := range mf.Rules {
+		for _, recipe := range rule.Recipes() {
+			addVarRefs(used, recipe)
+		}
+	}
+	for name, v := range mf.Vars {
+		if v.referenced {
+			used[name] = true
+		}
+		if !v.Simple {
+			addVarRefs(used, v.Value)
+		}
+	}
+
+	var issues []LintIssue
+	for _, name := range sortedVarNames(mf.Vars) {
+		if !used[name] {
+			issues = append(issues, LintIssue{Var: name, Message: "defined but never used"})
+		}
+	}
+	return issues
+}
+
+// addVarRefs adds the names of the variables that s references to refs.
+// Function names (such as "shell" in "$(shell ...)") are also added, which is
+// harmless.
+func addVarRefs(refs map[string]bool, s string) {
+	for i := strings.IndexByte(s, '$'); i != -1 && i < len(s)-1; i = strings.IndexByte(s, '$') {
+		switch c := s[i+1]; c {
+		case '$':
+			s = s[i+2:]
+		case '(', '{':
+			end := closingDelim(s, i+1)
+			if end == -1 {
+				return
+			}
+			ref := s[i+2 : end]
+			if j := strings.IndexAny(ref, ": \t"); j != -1 {
+				refs[ref[:j]] = true
+				addVarRefs(refs, ref[j:])
+			} else {
+				refs[ref] = true
+			}
+			s = s[end+1:]
+		default:
+			refs[string(c)] = true
+			s = s[i+2:]
+		}
+	}
+}
+
+// LintNoRecipes reports rules that have no recipes and aren't phony, which
+// means that their targets are never created.
+func LintNoRecipes(mf *Makefile) []LintIssue {
+	phony := mf.phonyTargets()
+	var issues []LintIssue
+	for _, rule := range mf.Rules {
+		target := rule.Target()
+		if len(rule.Recipes()) == 0 && !phony[target] && !strings.HasPrefix(target, ".") {
+			issues = append(issues, LintIssue{Target: target, Message: "rule has no recipes but is not .PHONY"})
+		}
+	}
+	return issues
+}
+
+// LintPhonyFiles reports phony targets whose names look like file names
+// (because they have a file extension or a directory), which usually means a
+// real file target was mistakenly declared phony.
+func LintPhonyFiles(mf *Makefile) []LintIssue {
+	rule := mf.Rule(".PHONY")
+	if rule == nil {
+		return nil
+	}
+	var issues []LintIssue
+	for _, target := range rule.Prereqs() {
+		if filepath.Ext(target) != "" || strings.ContainsRune(target, '/') {
+			issues = append(issues, LintIssue{Target: target, Message: "phony target looks like a file name"})
+		}
+	}
+	return issues
+}
+
+// LintLongRecipes returns a lint rule that reports rules with more than max
+// recipe lines, which are usually better moved into a script.
+func LintLongRecipes(max int) LintRule {
+	return func(mf *Makefile) []LintIssue {
+		var issues []LintIssue
+		for _, rule := range mf.Rules {
+			if n := len(rule.Recipes()); n > max {
+				issues = append(issues, LintIssue{
+					Target:  rule.Target(),
+					Message: fmt.Sprintf("rule has %d recipe lines (more than %d)", n, max),
+				})
+			}
+		}
+		return issues
+	}
+}
+
+// phonyTargets returns the set of targets that are prereqs of .PHONY.
+func (mf *Makefile) phonyTargets() map[string]bool {
+	phony := map[string]bool{}
+	if rule := mf.Rule(".PHONY"); rule != nil {
+		for _, p := range rule.Prereqs() {
+			phony[p] = true
+		}
+	}
+	return phony
+}
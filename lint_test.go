@@ -0,0 +1,47 @@
+package makex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMakefile_Lint(t *testing.T) {
+	mf, err := Parse([]byte(`
+CC = cc
+CFLAGS = -O2
+DIR := out
+UNUSED = x
+COMPILE = $(CC) $(CFLAGS)
+
+.PHONY: all x.o
+all: $(DIR)/x
+$(DIR)/x: x.o
+x.o: x.c
+	$(COMPILE) -c x.c
+	true
+	true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues := mf.Lint([]LintRule{LintUnusedVars, LintNoRecipes, LintPhonyFiles, LintLongRecipes(2)})
+	want := []LintIssue{
+		{Var: "UNUSED", Message: "defined but never used"},
+		{Target: "out/x", Message: "rule has no recipes but is not .PHONY"},
+		{Target: "x.o", Message: "phony target looks like a file name"},
+		{Target: "x.o", Message: "rule has 3 recipe lines (more than 2)"},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		t.Errorf("got issues %v, want %v", issues, want)
+	}
+}
+
+func TestAddVarRefs(t *testing.T) {
+	refs := map[string]bool{}
+	addVarRefs(refs, "$(A) ${B} $C $$D $(E:.c=.o) $(shell echo $(F))")
+	want := map[string]bool{"A": true, "B": true, "C": true, "E": true, "shell": true, "F": true}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("got refs %v, want %v", refs, want)
+	}
+}
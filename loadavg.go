@@ -0,0 +1,34 @@
+package makex
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// loadPollInterval is how often waitForLoad rechecks the load average.
+var loadPollInterval = time.Second
+
+// loadAverage returns the system's 1-minute load average. It is a variable so
+// that tests can replace it.
+var loadAverage = systemLoadAverage
+
+// waitForLoad blocks until the system load average is below c.MaxLoad or no
+// targets are running (so that the build always makes progress). It returns
+// false if the load average can't be determined on this system.
+func (c *Config) waitForLoad(running *int32) bool {
+	if c.MaxLoad <= 0 {
+		return true
+	}
+	for atomic.LoadInt32(running) > 0 {
+		load, err := loadAverage()
+		if err != nil {
+			c.logger().Printf("warning: ignoring max load %g: %s", c.MaxLoad, err)
+			return false
+		}
+		if load < c.MaxLoad {
+			break
+		}
+		time.Sleep(loadPollInterval)
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package makex
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// loadavg is the C struct loadavg returned by the vm.loadavg sysctl (as used
+// by getloadavg(3)).
+type loadavg struct {
+	ldavg  [3]uint32
+	fscale uintptr // a C long
+}
+
+// systemLoadAverage returns the system's 1-minute load average.
+func systemLoadAverage() (float64, error) {
+	s, err := syscall.Sysctl("vm.loadavg")
+	if err != nil {
+		return 0, err
+	}
+	// Sysctl drops a trailing zero byte from the value, so pad it back to
+	// the size of the struct.
+	var avg loadavg
+	buf := (*[unsafe.Sizeof(avg)]byte)(unsafe.Pointer(&avg))
+	if len(s) > len(buf) || len(s) < len(buf)-1 {
+		return 0, fmt.Errorf("unexpected vm.loadavg size %d", len(s))
+	}
+	copy(buf[:], s)
+	if avg.fscale == 0 {
+		return 0, fmt.Errorf("unexpected vm.loadavg fscale 0")
+	}
+	return float64(avg.ldavg[0]) / float64(avg.fscale), nil
+}
@@ -0,0 +1,21 @@
+package makex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// systemLoadAverage returns the system's 1-minute load average.
+func systemLoadAverage() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg contents: %q", data)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
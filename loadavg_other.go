@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package makex
+
+import (
+	"errors"
+	"runtime"
+)
+
+// systemLoadAverage returns the system's 1-minute load average.
+func systemLoadAverage() (float64, error) {
+	return 0, errors.New("load average is not available on " + runtime.GOOS)
+}
@@ -0,0 +1,69 @@
+package makex
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLoadAverage makes loadAverage return each of loads in turn (repeating
+// the last one), or err if it is non-nil, until the returned func is called.
+func fakeLoadAverage(loads []float64, err error) (calls *int, restore func()) {
+	orig, origInterval := loadAverage, loadPollInterval
+	calls = new(int)
+	loadAverage = func() (float64, error) {
+		i := *calls
+		*calls++
+		if err != nil {
+			return 0, err
+		}
+		if i >= len(loads) {
+			i = len(loads) - 1
+		}
+		return loads[i], nil
+	}
+	loadPollInterval = time.Millisecond
+	return calls, func() { loadAverage, loadPollInterval = orig, origInterval }
+}
+
+func TestConfig_waitForLoad(t *testing.T) {
+	calls, restore := fakeLoadAverage([]float64{5, 4, 1.5}, nil)
+	defer restore()
+
+	conf := &Config{MaxLoad: 2}
+	running := int32(1)
+	if !conf.waitForLoad(&running) {
+		t.Fatal("got waitForLoad false, want true")
+	}
+	if *calls != 3 {
+		t.Errorf("got %d load average checks, want 3 (until the load drops below MaxLoad)", *calls)
+	}
+
+	// Nothing is running, so there's no need to wait.
+	*calls = 0
+	running = 0
+	if !conf.waitForLoad(&running) {
+		t.Fatal("got waitForLoad false with nothing running, want true")
+	}
+	if *calls != 0 {
+		t.Errorf("got %d load average checks with nothing running, want 0", *calls)
+	}
+}
+
+func TestConfig_waitForLoad_unavailable(t *testing.T) {
+	_, restore := fakeLoadAverage(nil, errors.New("load average is not available"))
+	defer restore()
+
+	var buf bytes.Buffer
+	conf := &Config{MaxLoad: 2, Log: log.New(&buf, "", 0)}
+	running := int32(1)
+	if conf.waitForLoad(&running) {
+		t.Error("got waitForLoad true, want false when the load average is unavailable")
+	}
+	if want := "warning: ignoring max load 2: load average is not available"; !strings.Contains(buf.String(), want) {
+		t.Errorf("got log %q, want it to contain %q", buf.String(), want)
+	}
+}
@@ -1,36 +1,83 @@
 package makex
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/neelance/parallel"
 )
 
 // NewMaker creates a new Maker, which can build goals in a Makefile.
+//
+// If the goals' dependency graph exceeds c.MaxTargets or c.MaxRecipesPerRule,
+// NewMaker stops resolving it, and the Maker's TargetSetsNeedingBuild (and
+// therefore Run and DryRun) return an error.
 func (c *Config) NewMaker(mf *Makefile, goals ...string) *Maker {
 	m := &Maker{
 		mf:     mf,
 		goals:  goals,
-		cycles: make(map[string][]string),
 		Config: c,
 	}
-	m.buildDAG()
+	m.resetDAG()
 	return m
 }
 
+// resetDAG resolves the dependency graph of m's goals in m's makefile,
+// replacing the graph that was resolved before (if any).
+func (m *Maker) resetDAG() {
+	m.topo, m.err = nil, nil
+	m.cycles = make(map[string][]string)
+	m.rules = make(map[string]Rule)
+	m.dependents = make(map[string][]string)
+	start := time.Now()
+	m.buildDAG()
+	m.dagDuration = time.Since(start)
+}
+
 // A Maker can build goals in a Makefile.
 type Maker struct {
 	mf    *Makefile
 	goals []string
 	// topo is a topological sort of this Maker's targets. It only
 	// includes targets that have rules.
-	topo   [][]string
+	topo [][]string
+	// cycles maps each target that can't be built because of circular
+	// dependencies to a path of dependencies from it to a cycle and
+	// around the cycle, such as [a b c a] (see cyclePath).
 	cycles map[string][]string
 
+	// dagDuration is how long buildDAG took, and runDuration is how
+	// long the most recent call to Run took (see Result).
+	dagDuration, runDuration time.Duration
+
+	// err is the error, if any, that stopped buildDAG from building
+	// the full DAG.
+	err error
+
+	// rules maps each of this Maker's targets to its rule, so that rules
+	// instantiated from template rules are only created once.
+	rules map[string]Rule
+
+	// dag maps each of this Maker's targets to its prereqs that have
+	// rules.
+	dag map[string][]string
+
+	// dependents is the reverse of dag: it maps each of this Maker's
+	// targets' prereqs (whether or not they have rules) to the targets
+	// that directly depend on them.
+	dependents map[string][]string
+
 	// RuleOutput specifies the writers to receive the stdout and stderr output
 	// from executing a rule's recipes. After executing a rule, out and err are
 	// closed. If RuleOutput is nil, os.Stdout and
@@ -43,6 +90,82 @@ type Maker struct {
 	Started, Ended, Succeeded chan<- Rule
 	Failed                    chan<- RuleBuildError
 
+	// Hooks, if non-nil, is notified when each target starts building and
+	// when it succeeds or fails.
+	Hooks Hooks
+
+	// services are the services started during the current call to
+	// Run, in the order they were started.
+	servicesMu sync.Mutex
+	services   []*service
+
+	// lockGroups holds a mutex for each of the lock groups (see
+	// Config.LockGroups) of targets that have been built.
+	lockGroupsMu sync.Mutex
+	lockGroups   map[string]*sync.Mutex
+
+	// interrupted is 1 if the current call to Run received an interrupt
+	// signal (see Config.GracePeriod) or its context is done (see
+	// RunContext).
+	interrupted int32
+
+	// ctx is the context of the current call to Run (see RunContext).
+	ctx context.Context
+
+	// forced is the set of targets that the current call to Run builds
+	// whether or not they are stale (see RunAffectedBy and RunPlan).
+	forced map[string]bool
+
+	// planned, if non-nil, are the target sets that Run builds, in
+	// order, instead of the stale targets (see RunPlan).
+	planned [][]string
+
+	// procs are the recipe commands being run, which are killed if the
+	// grace period after an interrupt ends or the build is canceled (or
+	// sent the interrupt, see forwardSignals). After they are killed or
+	// signaled, procsKilled is set, and no new commands are started.
+	procsMu     sync.Mutex
+	procs       map[*exec.Cmd]struct{}
+	procsKilled bool
+
+	// unchanged is the set of targets whose contents were unchanged by
+	// being rebuilt (or that were skipped because of such targets) during
+	// the current call to Run (see Config.Restat).
+	unchangedMu sync.Mutex
+	unchanged   map[string]bool
+
+	// statCache caches the results of Stat calls during the current call
+	// to Run (see Config.DisableStatCache).
+	statCacheMu sync.Mutex
+	statCache   map[string]statResult
+
+	// onceGates holds the gates of the run-once targets that have
+	// started building during the current call to Run (see RunOnceRule).
+	onceGatesMu sync.Mutex
+	onceGates   map[string]*onceGate
+
+	// manifest records the targets built during the current call to
+	// Run (see Config.ManifestPath).
+	manifestMu sync.Mutex
+	manifest   []ManifestTarget
+
+	// statuses records what happened to each target that the most
+	// recent call to Run considered building (see BuildResult.Status).
+	statusesMu sync.Mutex
+	statuses   map[string]TargetStatus
+
+	// outputLineMu serializes calls to OnOutputLine and OnDiagnostic.
+	outputLineMu sync.Mutex
+
+	// groupOutputMu serializes writing targets' grouped output (see
+	// Config.GroupOutput).
+	groupOutputMu sync.Mutex
+
+	// timeline records when each target's recipes ran during the most
+	// recent call to Run.
+	timelineMu sync.Mutex
+	timeline   []TargetTiming
+
 	*Config
 }
 
@@ -66,17 +189,31 @@ func (m *Maker) buildDAG() {
 			}
 			seen[target] = struct{}{}
 
-			rule := m.mf.Rule(target)
+			rule := m.findRule(target)
 			if rule == nil {
 				// ignore targets that don't have
 				// rules, but don't error out.
 				continue
 			}
+			m.rules[target] = rule
+			if m.MaxTargets > 0 && len(m.rules) > m.MaxTargets {
+				m.err = fmt.Errorf("goals have more than %d targets (Config.MaxTargets)", m.MaxTargets)
+				return
+			}
+			if n := len(rule.Recipes()); m.MaxRecipesPerRule > 0 && n > m.MaxRecipesPerRule {
+				m.err = fmt.Errorf("target %q has %d recipes, more than %d (Config.MaxRecipesPerRule)", target, n, m.MaxRecipesPerRule)
+				return
+			}
+			if err := m.checkAllowed(target); err != nil {
+				m.err = err
+				return
+			}
 			prereqs := uniqAndSort(rule.Prereqs())
 			prereqsWithRules := []string{}
 			for _, dep := range prereqs {
+				m.dependents[filepath.Clean(dep)] = append(m.dependents[filepath.Clean(dep)], target)
 				// don't process dependencies that don't have rules
-				if m.mf.Rule(dep) == nil {
+				if m.rule(dep) == nil {
 					continue
 				}
 				prereqsWithRules = append(prereqsWithRules, dep)
@@ -91,6 +228,11 @@ func (m *Maker) buildDAG() {
 		queue = queue[origLen:]
 	}
 
+	m.dag = make(map[string][]string, len(dag))
+	for target, prereqs := range dag {
+		m.dag[target] = append([]string{}, prereqs...)
+	}
+
 	// topological sort on the DAG
 	for len(dag) > 0 {
 
@@ -103,21 +245,11 @@ func (m *Maker) buildDAG() {
 			}
 		}
 
-		// cycle detection
+		// cycle detection: the remaining targets are on cycles or
+		// depend on targets that are
 		if len(zero) == 0 {
-			// collect un-orderable dependencies
-			cycle := make(map[string]bool)
-			for _, prereqs := range dag {
-				for _, dep := range prereqs {
-					cycle[dep] = true
-				}
-			}
-
-			// mark targets with un-orderable dependencies
-			for target, prereqs := range dag {
-				if cycle[target] {
-					m.cycles[target] = prereqs
-				}
+			for target := range dag {
+				m.cycles[target] = cyclePath(dag, target)
 			}
 			return
 		}
@@ -140,6 +272,108 @@ func (m *Maker) buildDAG() {
 	}
 }
 
+// cyclePath returns a path of dependencies in dag from target to a cycle and
+// around the cycle, such as [a b c a] if target is on the cycle or [a b c b]
+// if it isn't. If target is on more than one cycle, the path is around the
+// shortest. Every target in dag must have a prereq in dag.
+func cyclePath(dag map[string][]string, target string) []string {
+	// search breadth-first for the shortest cycle through target
+	parent := make(map[string]string)
+	queue := []string{target}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		for _, dep := range dag[t] {
+			if dep == target {
+				path := []string{target}
+				for ; t != target; t = parent[t] {
+					path = append(path, t)
+				}
+				path = append(path, target)
+				for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+					path[i], path[j] = path[j], path[i]
+				}
+				return path
+			}
+			if _, seen := parent[dep]; !seen {
+				parent[dep] = t
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	// target isn't on a cycle, so follow its prereqs until one repeats
+	var path []string
+	seen := make(map[string]bool)
+	for t := target; !seen[t]; t = dag[t][0] {
+		seen[t] = true
+		path = append(path, t)
+	}
+	return append(path, dag[path[len(path)-1]][0])
+}
+
+// checkAllowed returns a ForbiddenTargetError if m.AllowTargets and
+// m.DenyTargets forbid building target.
+func (m *Maker) checkAllowed(target string) error {
+	for _, pattern := range m.DenyTargets {
+		match, err := filepath.Match(pattern, target)
+		if err != nil {
+			return fmt.Errorf("bad DenyTargets pattern %q: %s", pattern, err)
+		}
+		if match {
+			return &ForbiddenTargetError{Target: target, Pattern: pattern}
+		}
+	}
+	if len(m.AllowTargets) == 0 {
+		return nil
+	}
+	for _, pattern := range m.AllowTargets {
+		match, err := filepath.Match(pattern, target)
+		if err != nil {
+			return fmt.Errorf("bad AllowTargets pattern %q: %s", pattern, err)
+		}
+		if match {
+			return nil
+		}
+	}
+	return &ForbiddenTargetError{Target: target}
+}
+
+// rule returns the rule to make target. Targets in the DAG use the rule
+// resolved by buildDAG.
+func (m *Maker) rule(target string) Rule {
+	if rule, ok := m.rules[target]; ok {
+		return rule
+	}
+	return m.findRule(target)
+}
+
+// findRule returns the makefile's rule to make target (see Makefile.Rule),
+// skipping pattern rules whose prereqs for target don't exist and can't be
+// made.
+func (m *Maker) findRule(target string) Rule {
+	return m.findRuleIn(target, make(map[string]bool))
+}
+
+// findRuleIn is like findRule, but it treats the targets in resolving (whose
+// rules are being found) as if they can't be made, since pattern rules can
+// chain.
+func (m *Maker) findRuleIn(target string, resolving map[string]bool) Rule {
+	resolving[target] = true
+	defer delete(resolving, target)
+	return m.mf.rule(target, func(r Rule) bool {
+		for _, prereq := range r.Prereqs() {
+			if exists, err := m.pathExists(prereq); err == nil && exists {
+				continue
+			}
+			if resolving[prereq] || m.findRuleIn(prereq, resolving) == nil {
+				return false
+			}
+		}
+		return true
+	})
+}
+
 // TargetSets returns a topologically sorted list of sets of target
 // names. To only get targets that are stale and need to be built, use
 // TargetSetsNeedingBuild.
@@ -150,69 +384,219 @@ func (m *Maker) TargetSets() [][]string {
 // TargetSetsNeedingBuild returns a topologically sorted list of sets
 // of target names that need to be built (i.e., that are stale).
 func (m *Maker) TargetSetsNeedingBuild() ([][]string, error) {
-	for _, goal := range m.goals {
-		if rule := m.mf.Rule(goal); rule == nil {
-			return nil, errNoRuleToMakeTarget(goal)
-		}
-		if deps, isCycle := m.cycles[goal]; isCycle {
-			return nil, errCircularDependency(goal, deps)
-		}
+	if err := m.checkGoals(); err != nil {
+		return nil, err
 	}
 
 	targetSets := make([][]string, 0)
+	known := make(map[string]bool)
 	for _, targetSet := range m.topo {
 		var targetsNeedingBuild []string
 		for _, target := range targetSet {
-			// Always build .PHONY target
-			if isPhony(m, target) {
-				targetsNeedingBuild = append(targetsNeedingBuild, target)
-				continue
-			}
-			exists, err := m.pathExists(target)
+			stale, err := m.isStaleIn(target, known)
 			if err != nil {
 				return nil, err
 			}
-			// Always build the target if it doesn't
-			// exist.
-			if !exists {
+			if stale {
 				targetsNeedingBuild = append(targetsNeedingBuild, target)
-				continue
 			}
-			// The target needs to be built if the mtime
-			// of one of the target's files is greater
-			// than the mtime of the target.
-			targetModTime, err := m.modTime(target)
-			if err != nil {
-				return nil, err
+		}
+		if len(targetsNeedingBuild) > 0 {
+			targetSets = append(targetSets, targetsNeedingBuild)
+		}
+	}
+	return m.withoutUnneededServices(targetSets), nil
+}
+
+// checkGoals returns an error if any of m's goals can't be built.
+func (m *Maker) checkGoals() error {
+	if m.err != nil {
+		return m.err
+	}
+	for _, goal := range m.goals {
+		if rule := m.rule(goal); rule == nil {
+			return errNoRuleToMakeTarget(goal)
+		}
+		if path, isCycle := m.cycles[goal]; isCycle {
+			return errCircularDependency(goal, path)
+		}
+	}
+	return nil
+}
+
+// isStale reports whether target needs to be built.
+func (m *Maker) isStale(target string) (bool, error) {
+	return m.isStaleIn(target, make(map[string]bool))
+}
+
+// isStaleIn is like isStale, but it uses and adds to known, which records
+// whether each target that has already been checked is stale.
+func (m *Maker) isStaleIn(target string, known map[string]bool) (bool, error) {
+	if stale, ok := known[target]; ok {
+		return stale, nil
+	}
+	stale, _, err := m.stalenessIn(target, known)
+	return stale, err
+}
+
+// staleness reports whether target needs to be built, along with a sentence
+// explaining why (or why not).
+//
+// A target is stale if it is phony or a service, if any of its outputs don't
+// exist, or if any of its prereqs or stale inputs are newer than its oldest
+// output. It is also stale if any of its prereqs that have rules are stale,
+// because they will be newer than the target once they are built.
+func (m *Maker) staleness(target string) (stale bool, reason string, err error) {
+	return m.stalenessIn(target, make(map[string]bool))
+}
+
+// stalenessIn is like staleness, but it uses and adds to known (see
+// isStaleIn).
+func (m *Maker) stalenessIn(target string, known map[string]bool) (stale bool, reason string, err error) {
+	// Treat target as up to date while checking it, in case it (wrongly)
+	// depends on itself.
+	known[target] = false
+	defer func() {
+		if err == nil {
+			known[target] = stale
+		}
+	}()
+
+	// Always build .PHONY target
+	if isPhony(m, target) {
+		return true, fmt.Sprintf("%s is phony, so it is always built", target), nil
+	}
+	if m.forced[target] {
+		return true, fmt.Sprintf("%s is built whether or not it is up to date", target), nil
+	}
+	rule := m.rule(target)
+	if rule == nil {
+		return false, "", errNoRuleToMakeTarget(target)
+	}
+	if isService(rule) {
+		return true, fmt.Sprintf("%s is a service, so it is always started", target), nil
+	}
+
+	// Always build the target if any of its outputs don't exist.
+	// Otherwise, the oldest output determines whether the target is
+	// up to date.
+	var oldest time.Time
+	var oldestOutput string
+	for i, output := range ruleOutputs(rule) {
+		exists, err := m.pathExists(output)
+		if err != nil {
+			return false, "", err
+		}
+		if !exists {
+			if output == target {
+				return true, fmt.Sprintf("%s does not exist", target), nil
 			}
-			rule := m.mf.Rule(target)
-			if rule == nil {
-				return nil, errNoRuleToMakeTarget(target)
+			return true, fmt.Sprintf("%s's output %s does not exist", target, output), nil
+		}
+		t, err := m.modTime(output)
+		if err != nil {
+			return false, "", err
+		}
+		if i == 0 || t.Before(oldest) {
+			oldest, oldestOutput = t, output
+		}
+	}
+
+	// The target needs to be built if the mtime
+	// of one of the target's files is greater
+	// than the mtime of the target.
+	prereqs := rule.Prereqs()
+	if m.RebuildOnMakefileChange {
+		prereqs = append(append([]string{}, prereqs...), m.mf.Sources...)
+	}
+	var newest time.Time
+	var newestPrereq string
+	for _, p := range prereqs {
+		if isPhony(m, p) {
+			return true, fmt.Sprintf("%s depends on phony target %s", target, p), nil
+		}
+		if isService(m.rule(p)) || m.isUnchanged(p) {
+			continue
+		}
+		if _, hasRule := m.rules[p]; hasRule {
+			stale, err := m.isStaleIn(p, known)
+			if err != nil {
+				return false, "", err
 			}
-			for _, p := range rule.Prereqs() {
-				if isPhony(m, p) {
-					targetsNeedingBuild = append(targetsNeedingBuild, target)
-					break
-				}
-				m, err := m.modTime(p)
-				if err != nil {
-					return nil, err
-				}
-				if m.After(targetModTime) {
-					targetsNeedingBuild = append(targetsNeedingBuild, target)
-					break
-				}
+			if stale {
+				return true, fmt.Sprintf("prereq %s needs to be built", p), nil
 			}
 		}
-		if len(targetsNeedingBuild) > 0 {
-			targetSets = append(targetSets, targetsNeedingBuild)
+		t, err := m.modTime(p)
+		if err != nil {
+			return false, "", err
+		}
+		if t.After(oldest) {
+			return true, fmt.Sprintf("prereq %s (at %s) is newer than %s (at %s)", p, formatModTime(t), oldestOutput, formatModTime(oldest)), nil
+		}
+		if newestPrereq == "" || t.After(newest) {
+			newest, newestPrereq = t, p
 		}
 	}
-	return targetSets, nil
+	for _, p := range staleInputs(rule) {
+		t, err := m.modTime(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, "", err
+		}
+		if t.After(oldest) {
+			return true, fmt.Sprintf("stale input %s (at %s) is newer than %s (at %s)", p, formatModTime(t), oldestOutput, formatModTime(oldest)), nil
+		}
+	}
+	if newestPrereq == "" {
+		return false, fmt.Sprintf("%s exists and has no prereqs", target), nil
+	}
+	return false, fmt.Sprintf("%s is newer than all prereqs (newest prereq %s at %s)", oldestOutput, newestPrereq, formatModTime(newest)), nil
+}
+
+// ExplainUpToDate returns a sentence explaining why target is up to date and
+// won't be built by Run (or, if it is stale, why it will be built).
+func (m *Maker) ExplainUpToDate(target string) (string, error) {
+	stale, reason, err := m.staleness(target)
+	if err != nil {
+		return "", err
+	}
+	if stale {
+		return fmt.Sprintf("%s is not up to date: %s", target, reason), nil
+	}
+	return reason, nil
+}
+
+func formatModTime(t time.Time) string { return t.Format(time.RFC3339Nano) }
+
+// RecipeGroups groups the makefile's targets by their recipes' text before
+// automatic variable expansion (see ExpandAutoVars and RecipeSourcesRule), so
+// that targets that share a recipe template (differing only by $@, $^, and
+// $<) are grouped together. The map keys are the recipe templates joined by newlines, and the
+// values are the sorted targets. Rules without recipes are omitted.
+func (m *Maker) RecipeGroups() map[string][]string {
+	groups := make(map[string][]string)
+	for _, rule := range m.mf.Rules {
+		sources := recipeSources(rule)
+		if len(sources) == 0 {
+			continue
+		}
+		key := strings.Join(sources, "\n")
+		groups[key] = append(groups[key], rule.Target())
+	}
+	for _, targets := range groups {
+		sort.Strings(targets)
+	}
+	return groups
 }
 
 // DryRun prints information about what targets *would* be built if Run() was
-// called.
+// called: each target set that needs building, and under each of its targets,
+// the recipes that Run would run, expanded as Run would expand them (so "$@"
+// and "$<" show the target and prereq). Like "make -n", DryRun runs no
+// recipes, but it does run the commands in any "$(shell ...)" function calls.
 func (m *Maker) DryRun(w io.Writer) error {
 	targetSets, err := m.TargetSetsNeedingBuild()
 	if err != nil {
@@ -228,6 +612,18 @@ func (m *Maker) DryRun(w io.Writer) error {
 		fmt.Fprintf(w, "========= TARGET SET %d (%d targets)\n", i, len(targetSet))
 		for _, target := range targetSet {
 			fmt.Fprintln(w, " - ", target)
+			rule := m.rule(target)
+			recipes := rule.Recipes()
+			if _, planned := rule.(*plannedRule); !planned {
+				recipes = m.SelectRecipes(recipes)
+			}
+			for _, recipe := range recipes {
+				expanded, err := m.expandRecipe(rule, recipe)
+				if err != nil {
+					return fmt.Errorf("expanding recipe for target %s failed: %s (%s)", target, recipe, err)
+				}
+				fmt.Fprintf(w, "\t%s\n", expanded)
+			}
 		}
 	}
 	return nil
@@ -237,78 +633,649 @@ func (m *Maker) DryRun(w io.Writer) error {
 // of a rule's recipe commands.
 func (m *Maker) ruleOutput(r Rule) (stdout io.WriteCloser, stderr io.WriteCloser, logger *log.Logger) {
 	if m.RuleOutput != nil {
-		return m.RuleOutput(r)
+		stdout, stderr, logger = m.RuleOutput(r)
+	} else {
+		stdout, stderr, logger = nopCloser{os.Stdout}, nopCloser{os.Stderr}, log.New(os.Stderr, fmt.Sprintf("%s: ", r.Target()), 0)
+	}
+	if m.PrefixOutput || m.GroupOutput {
+		stdout, stderr, logger = m.withOutputOptions(r, stdout, stderr, logger)
 	}
-	return nopCloser{os.Stdout}, nopCloser{os.Stderr}, log.New(os.Stderr, fmt.Sprintf("%s: ", r.Target()), 0)
+	if m.PerTargetLogDir != "" {
+		stdout, stderr, logger = m.withTargetLog(r, stdout, stderr, logger)
+	}
+	return stdout, stderr, logger
 }
 
 // Run builds all stale targets.
+//
+// If any targets fail to build, Run returns an Errors value whose elements
+// are RuleBuildErrors ordered by target name (regardless of the order in
+// which the targets failed), so that the first error is stable from run to
+// run.
+//
+// If the build fails and m.TransientError reports that all of the errors are
+// transient, Run retries the build (of the targets that still need to be
+// built) up to m.BuildRetries times.
 func (m *Maker) Run() error {
-	targetSets, err := m.TargetSetsNeedingBuild()
-	if err != nil {
+	return m.RunContext(context.Background())
+}
+
+// RunContext is like Run, but it stops the build when ctx is done: no new
+// targets are started, and the running recipes are killed (so their targets
+// fail and are removed). RunContext then returns a *CanceledError that wraps
+// ctx.Err().
+//
+// If ctx can be canceled, recipes are run in their own process groups (as with
+// Config.GracePeriod), so that the processes they start are killed too. Unless
+// Config.GracePeriod is set, interrupt signals (SIGINT and SIGTERM) received
+// during the build are then forwarded to the recipes, and no new targets are
+// started.
+func (m *Maker) RunContext(ctx context.Context) error {
+	return m.runSelected(ctx, nil)
+}
+
+// RunTagged is like Run, except that it only builds the stale targets (among
+// those needed to build m's goals) that have tag (see TagsRule), and their
+// prereqs (whether or not the prereqs have tag).
+func (m *Maker) RunTagged(tag string) error {
+	selected := make(map[string]bool)
+	var add func(target string)
+	add = func(target string) {
+		if selected[target] {
+			return
+		}
+		selected[target] = true
+		for _, prereq := range m.dag[target] {
+			add(prereq)
+		}
+	}
+	for target, rule := range m.rules {
+		if hasTag(rule, tag) {
+			add(target)
+		}
+	}
+	return m.runSelected(context.Background(), selected)
+}
+
+// runSelected builds the stale targets that are in selected (or all stale
+// targets, if selected is nil), retrying as described in the Run
+// documentation, until ctx is done.
+func (m *Maker) runSelected(ctx context.Context, selected map[string]bool) (err error) {
+	start := time.Now()
+	defer func() { m.runDuration = time.Since(start) }()
+	m.ctx = ctx
+	defer func() { m.ctx = nil }()
+	defer func() {
+		if ctx.Err() != nil {
+			err = m.errCanceled(ctx.Err())
+		}
+	}()
+	defer m.startStatCache()()
+	m.resetStatuses()
+	m.onceGatesMu.Lock()
+	m.onceGates = nil
+	m.onceGatesMu.Unlock()
+	m.manifestMu.Lock()
+	m.manifest = nil
+	m.manifestMu.Unlock()
+	if m.ManifestPath != "" {
+		defer func() {
+			if err2 := m.writeManifest(); err2 != nil && err == nil {
+				err = fmt.Errorf("writing manifest failed: %s", err2)
+			}
+		}()
+	}
+	for attempt := 1; ; attempt++ {
+		var targetSets [][]string
+		if m.planned != nil {
+			targetSets, err = m.plannedNeedingBuild()
+		} else {
+			targetSets, err = m.TargetSetsNeedingBuild()
+		}
+		if err != nil {
+			return err
+		}
+		if selected != nil {
+			targetSets = selectTargets(targetSets, selected)
+		}
+		err = m.run(targetSets)
+		if err == nil || attempt > m.BuildRetries || !m.isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		// Don't force the targets that were built to be built again.
+		for target, status := range m.targetStatuses() {
+			if status == TargetBuilt {
+				delete(m.forced, target)
+			}
+		}
+		m.logger().Printf("build failed with transient errors; retrying (retry %d of %d)", attempt, m.BuildRetries)
+	}
+}
+
+// selectTargets returns the targets in targetSets that are in selected,
+// omitting target sets that become empty.
+func selectTargets(targetSets [][]string, selected map[string]bool) [][]string {
+	var sets [][]string
+	for _, targetSet := range targetSets {
+		var set []string
+		for _, target := range targetSet {
+			if selected[target] {
+				set = append(set, target)
+			}
+		}
+		if len(set) > 0 {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// isTransient reports whether err (returned by run) consists only of
+// RuleBuildErrors that m.TransientError reports are transient.
+func (m *Maker) isTransient(err error) bool {
+	errs, ok := err.(Errors)
+	if !ok || m.TransientError == nil {
+		return false
+	}
+	for _, err := range errs {
+		if _, ok := err.(RuleBuildError); !ok || !m.TransientError(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// run builds the targets in targetSets, one target set at a time. Services
+// started during the build are stopped before it returns.
+func (m *Maker) run(targetSets [][]string) error {
+	if err := m.checkShell(); err != nil {
 		return err
 	}
+	defer m.stopServices()
+
+	atomic.StoreInt32(&m.interrupted, 0)
+	m.procsMu.Lock()
+	m.procsKilled = false
+	m.procsMu.Unlock()
+	if m.GracePeriod > 0 {
+		defer m.handleSignals()()
+	} else if m.usesProcessGroups() {
+		defer m.forwardSignals()()
+	}
+	if m.context().Done() != nil {
+		defer m.handleCancel()()
+	}
+
+	m.timelineMu.Lock()
+	m.timeline = nil
+	m.timelineMu.Unlock()
+
+	m.unchangedMu.Lock()
+	m.unchanged = nil
+	m.unchangedMu.Unlock()
+
+	// slots hands out worker slot numbers so that the timeline can show
+	// which targets ran concurrently.
+	nslots := m.ParallelJobs
+	if nslots < 1 {
+		nslots = 1
+	}
+	slots := make(chan int, nslots)
+	for i := 0; i < nslots; i++ {
+		slots <- i
+	}
+
+	// running is the number of targets currently being built.
+	var running int32
+	checkLoad := m.MaxLoad > 0
+
+	prog := newProgress(targetSets)
+	if m.SummaryInterval > 0 {
+		defer m.logSummaries(prog)()
+	}
+
+	for _, targetSet := range targetSets {
+		for _, target := range targetSet {
+			m.setStatus(target, TargetNotBuilt)
+		}
+	}
+
+	// With KeepGoing, errs are the errors of the targets that failed, and
+	// failed is the set of those targets and the targets that were
+	// skipped because they depend on them.
+	var errs Errors
+	failed := make(map[string]bool)
 
 	for i, targetSet := range targetSets {
+		if m.isInterrupted() {
+			return m.errInterrupted()
+		}
 		m.logTargetSetStart(i, targetSet)
+		if len(failed) > 0 {
+			targetSet = m.skipFailedDependents(targetSet, failed, prog)
+		}
+		if m.Restat {
+			var targets []string
+			for _, target := range targetSet {
+				if m.restatSkip(target) {
+					m.setStatus(target, TargetSkipped)
+					atomic.AddInt32(&prog.done, 1)
+				} else {
+					targets = append(targets, target)
+				}
+			}
+			targetSet = targets
+		}
+		var leaders, followers map[string]*coalescedBuild
+		if m.CoalesceIdenticalRecipes {
+			// Start the leaders before their followers.
+			targetSet = append([]string{}, targetSet...)
+			sort.Strings(targetSet)
+			leaders, followers = m.coalesce(targetSet)
+		}
 		par := parallel.NewRun(m.ParallelJobs)
+		var coalesced sync.WaitGroup
 		for _, target := range targetSet {
-			rule := m.mf.Rule(target)
+			rule := m.rule(target)
+			if b := followers[target]; b != nil {
+				coalesced.Add(1)
+				go func() {
+					defer coalesced.Done()
+					m.buildCoalesced(rule, b, prog, par)
+				}()
+				continue
+			}
+			leader := leaders[target]
+			if checkLoad {
+				checkLoad = m.waitForLoad(&running)
+			}
 			par.Acquire()
+			if m.isInterrupted() {
+				par.Release()
+				break
+			}
+			atomic.AddInt32(&running, 1)
 			go func() {
 				defer par.Release()
+				defer atomic.AddInt32(&running, -1)
+				slot := <-slots
+				defer func() { slots <- slot }()
+
+				if m.LockGroups != nil {
+					if group := m.LockGroups(rule); group != "" {
+						mu := m.lockGroup(group)
+						mu.Lock()
+						defer mu.Unlock()
+					}
+				}
+				atomic.AddInt32(&prog.running, 1)
+				defer atomic.AddInt32(&prog.running, -1)
 
 				stdout, stderr, log := m.ruleOutput(rule)
+				if m.OnOutputLine != nil || m.OnDiagnostic != nil {
+					stdout, stderr = m.withLineWriters(rule, stdout, stderr)
+				}
 				if m.Started != nil {
 					m.Started <- rule
 				}
-				defer stdout.Close()
-				defer stderr.Close()
+				if m.Hooks != nil {
+					m.Hooks.OnTargetStart(rule.Target())
+				}
+				timing := TargetTiming{Target: rule.Target(), Slot: slot, Start: time.Now()}
+				defer func() {
+					// A running service's output is closed when
+					// the service is stopped.
+					if !m.isRunningService(rule) {
+						stdout.Close()
+						stderr.Close()
+					}
+				}()
 				defer func() {
 					if m.Ended != nil {
 						m.Ended <- rule
 					}
 				}()
+				defer func() {
+					timing.End = time.Now()
+					m.recordTiming(timing)
+				}()
 
-				for _, recipe := range rule.Recipes() {
-					recipe = ExpandAutoVars(rule, recipe)
+				if m.SlowTargetThreshold > 0 {
+					slowLog := log
+					if m.GroupOutput {
+						// Warn now, not after the target
+						// finishes.
+						slowLog = m.logger()
+					}
+					defer m.warnIfSlow(rule, slowLog)()
+				}
+				var oldHash []byte
+				if m.Restat {
+					oldHash = m.outputsHash(rule)
+				}
+				err := m.buildOnce(rule, log, func() error {
+					err := m.runRecipes(rule, stdout, stderr, log, &timing)
+					if err == nil {
+						err = m.checkOutputs(rule, log)
+					}
+					return err
+				})
+				if err == nil && oldHash != nil && bytes.Equal(oldHash, m.outputsHash(rule)) {
 					if m.Verbose {
-						log.Printf("running command: %s", recipe)
+						log.Print("contents unchanged; not rebuilding dependents on its account")
 					}
-					cmd := exec.Command("sh", "-c", recipe)
-					cmd.Stdout, cmd.Stderr = stdout, stderr
-
-					err := cmd.Run()
-					if err != nil {
-						// remove files if failed
-						if exists, _ := m.pathExists(rule.Target()); exists {
-							err2 := m.fs().Remove(rule.Target())
-							if err2 != nil {
-								log.Printf("failed to remove target after error: %s", err)
-							}
-						}
-
-						log.Printf(`command failed: %s (%s)`, recipe, err)
-						err2 := RuleBuildError{rule, fmt.Errorf("command failed: %s (%s)", recipe, err)}
-						if m.Failed != nil {
-							m.Failed <- err2
-						}
-						par.Error(err2)
-						return
+					m.markUnchanged(rule.Target())
+				}
+				if err == nil && m.ManifestPath != "" {
+					if err = m.recordManifest(rule, timing.Recipes); err != nil {
+						err = fmt.Errorf("hashing inputs and outputs for manifest failed: %s", err)
 					}
 				}
+				if leader != nil {
+					leader.err, leader.recipes = err, timing.Recipes
+					close(leader.done)
+				}
+				if err != nil {
+					m.removeOutputs(rule, log)
+					log.Print(err)
+					err2 := RuleBuildError{rule, err}
+					timing.Err = err2
+					m.setFailedStatus(rule.Target())
+					atomic.AddInt32(&prog.failed, 1)
+					if m.Failed != nil {
+						m.Failed <- err2
+					}
+					if m.Hooks != nil {
+						m.Hooks.OnTargetFailure(rule.Target(), err)
+					}
+					par.Error(err2)
+					return
+				}
 
+				m.setStatus(rule.Target(), TargetBuilt)
+				atomic.AddInt32(&prog.done, 1)
 				if m.Succeeded != nil {
 					m.Succeeded <- rule
 				}
+				if m.Hooks != nil {
+					m.Hooks.OnTargetSuccess(rule.Target(), time.Since(timing.Start))
+				}
 			}()
 		}
+		coalesced.Wait()
 		err := par.Wait()
 		if err != nil {
-			return Errors(err.(parallel.Errors))
+			setErrs := Errors(err.(parallel.Errors))
+			if !m.KeepGoing {
+				setErrs.sort()
+				return setErrs
+			}
+			for _, err := range setErrs {
+				failed[err.(RuleBuildError).Rule.Target()] = true
+			}
+			errs = append(errs, setErrs...)
+		}
+	}
+
+	if m.isInterrupted() {
+		return m.errInterrupted()
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		return errs
+	}
+	return nil
+}
+
+// skipFailedDependents returns the targets in targetSet that don't have
+// prereqs in failed (see Config.KeepGoing). It adds the others to failed
+// (so that their dependents are skipped too), and logs and counts them as
+// failed.
+func (m *Maker) skipFailedDependents(targetSet []string, failed map[string]bool, prog *progress) []string {
+	var targets []string
+	for _, target := range targetSet {
+		var failedPrereq string
+		for _, prereq := range m.rule(target).Prereqs() {
+			if failed[prereq] {
+				failedPrereq = prereq
+				break
+			}
+		}
+		if failedPrereq == "" {
+			targets = append(targets, target)
+			continue
+		}
+		failed[target] = true
+		m.setStatus(target, TargetPrereqFailed)
+		atomic.AddInt32(&prog.failed, 1)
+		m.logger().Printf("not building %s because its prereq %s failed", target, failedPrereq)
+	}
+	return targets
+}
+
+// removeOutputs removes rule's outputs after its recipes failed, except for a
+// service's (which has no outputs), a staged target (which is intact), and a
+// phony target (which isn't a file that the recipes create, even if a file
+// with its name exists).
+func (m *Maker) removeOutputs(rule Rule, log *log.Logger) {
+	if isService(rule) {
+		return
+	}
+	phony := isPhony(m, rule.Target())
+	for _, output := range ruleOutputs(rule) {
+		if output == rule.Target() && (phony || m.stagesTarget(rule)) {
+			// the original target is intact, or there is none
+			continue
+		}
+		if exists, _ := m.pathExists(output); exists {
+			err := m.fs().Remove(output)
+			if err != nil {
+				log.Printf("failed to remove %s after error: %s", output, err)
+			}
+			m.invalidateStats(output)
+		}
+	}
+}
+
+// lockGroup returns the mutex for the named lock group.
+func (m *Maker) lockGroup(name string) *sync.Mutex {
+	m.lockGroupsMu.Lock()
+	defer m.lockGroupsMu.Unlock()
+	if m.lockGroups == nil {
+		m.lockGroups = make(map[string]*sync.Mutex)
+	}
+	mu, ok := m.lockGroups[name]
+	if !ok {
+		mu = new(sync.Mutex)
+		m.lockGroups[name] = mu
+	}
+	return mu
+}
+
+// runRecipes expands and runs each of rule's recipes in order, stopping at the
+// first one that fails.
+func (m *Maker) runRecipes(rule Rule, stdout, stderr io.WriteCloser, log *log.Logger, timing *TargetTiming) error {
+	// The recipes may have created, changed, or removed the outputs.
+	defer m.invalidateStats(ruleOutputs(rule)...)
+
+	recipes := rule.Recipes()
+	if _, planned := rule.(*plannedRule); !planned {
+		recipes = m.SelectRecipes(recipes)
+	}
+	var staging string
+	if m.stagesTarget(rule) {
+		staging = stagingFile(rule.Target())
+		defer func() {
+			m.invalidateStats(staging)
+			if exists, _ := m.pathExists(staging); exists {
+				m.fs().Remove(staging)
+			}
+			m.invalidateStats(staging)
+		}()
+	}
+	var wrapper []string
+	if len(m.FakerootCommand) > 0 {
+		var cleanup func()
+		var err error
+		if wrapper, cleanup, err = m.fakerootWrapper(); err != nil {
+			return fmt.Errorf("creating fakeroot state file failed: %s", err)
+		}
+		defer cleanup()
+	}
+	for i, recipe := range recipes {
+		expanded, err := m.expandRecipe(rule, recipe)
+		if err != nil {
+			return fmt.Errorf("expanding recipe failed: %s (%s)", recipe, err)
+		}
+		recipe = expanded
+		if staging != "" {
+			recipe = replaceWord(recipe, Quote(rule.Target()), Quote(staging))
+		}
+		timing.Recipes = append(timing.Recipes, recipe)
+		if m.Verbose {
+			if m.MaxEchoLines <= 0 || i < m.MaxEchoLines {
+				log.Printf("running command: %s", recipe)
+			} else if i == m.MaxEchoLines {
+				log.Printf("... (%d more lines)", len(recipes)-i)
+			}
+		}
+		if i == len(recipes)-1 && isService(rule) {
+			if err := m.startService(rule, recipe, stdout, stderr); err != nil {
+				return fmt.Errorf("starting service failed: %s (%s)", recipe, err)
+			}
+			continue
+		}
+		err = m.runRecipe(rule, recipe, wrapper, stdout, stderr)
+		flushLines(stdout, stderr)
+		if err != nil {
+			return &RecipeError{Target: rule.Target(), Recipe: recipe, Index: i + 1, Count: len(recipes), Err: err}
+		}
+	}
+	if staging != "" {
+		m.invalidateStats(staging)
+		if exists, _ := m.pathExists(staging); exists {
+			if err := rename(m.fs(), staging, rule.Target()); err != nil {
+				return fmt.Errorf("renaming %s to %s failed: %s", staging, rule.Target(), err)
+			}
 		}
 	}
+	return nil
+}
+
+// stagesTarget reports whether rule's recipes build its target at a staging
+// path that is renamed to the target after they succeed (see
+// Config.AtomicTargets).
+func (m *Maker) stagesTarget(rule Rule) bool {
+	return m.AtomicTargets && len(rule.Recipes()) > 0 && !isPhony(m, rule.Target()) && !isService(rule)
+}
 
+// stagingFile returns the staging path for target (see Config.AtomicTargets).
+func stagingFile(target string) string {
+	dir, base := filepath.Split(target)
+	return filepath.Join(dir, "."+base+".makex-staging")
+}
+
+// ValidateRecipes expands the recipes of all of the targets that need to be
+// built, without running them (or the commands in any "$(shell ...)" function
+// calls), to check for errors that would otherwise only be found during the
+// build. In addition to the errors that expandRecipe reports, references to
+// variables that are defined neither in the makefile nor in the environment
+// (including "$*" in rules that aren't pattern rules) and calls to unknown
+// functions are errors.
+//
+// It returns an Errors value containing a RuleBuildError for each recipe that
+// can't be expanded, ordered by target name.
+func (m *Maker) ValidateRecipes() error {
+	targetSets, err := m.TargetSetsNeedingBuild()
+	if err != nil {
+		return err
+	}
+	if !m.mf.expandsVars() {
+		// Only automatic variables are expanded, which can't fail.
+		return nil
+	}
+	var errs Errors
+	for _, targetSet := range targetSets {
+		for _, target := range targetSet {
+			rule := m.rule(target)
+			if _, planned := rule.(*plannedRule); planned {
+				continue
+			}
+			for _, recipe := range m.SelectRecipes(rule.Recipes()) {
+				x := m.recipeExpander(rule)
+				x.shell, x.strict = noShell, true
+				if _, err := x.expand(ExpandAutoVars(rule, recipe)); err != nil {
+					errs = append(errs, RuleBuildError{rule, fmt.Errorf("expanding recipe failed: %s (%s)", recipe, err)})
+				}
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	errs.sort()
+	return errs
+}
+
+// checkOutputs checks that rule's recipes created its outputs, which usually
+// indicates that the recipes write to the wrong path. Missing outputs are
+// reported as a warning, or as an error if m.Strict is set. Phony targets,
+// services, and rules without recipes are not checked.
+func (m *Maker) checkOutputs(rule Rule, log *log.Logger) error {
+	if len(rule.Recipes()) == 0 || isPhony(m, rule.Target()) || isService(rule) {
+		return nil
+	}
+	for _, output := range ruleOutputs(rule) {
+		exists, err := m.pathExists(output)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if m.Strict {
+				return fmt.Errorf("recipes succeeded but did not create %s", output)
+			}
+			log.Printf("warning: recipes succeeded but did not create %s", output)
+		}
+	}
+	return nil
+}
+
+// runRecipe runs a single (expanded) recipe command of rule, either by calling
+// a builtin (see Config.Builtins) or by passing it to the shell.
+func (m *Maker) runRecipe(rule Rule, recipe string, wrapper []string, stdout, stderr io.Writer) error {
+	if name, args, ok := parseBuiltinCall(recipe); ok {
+		return m.callBuiltin(rule, name, args)
+	}
+	cmd, err := m.shellCommand(recipe, wrapper...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if m.usesProcessGroups() {
+		return m.runCmd(rule, cmd)
+	}
+	if err := m.startCmd(rule, cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// startCmd starts cmd, which runs one of rule's recipes, with the
+// environment given by recipeEnv and the niceness given by m.Nice (if set).
+func (m *Maker) startCmd(rule Rule, cmd *exec.Cmd) error {
+	cmd.Env = m.recipeEnv()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if m.Nice != nil {
+		if n := m.Nice(rule); n != 0 {
+			if err := setNice(cmd, n); err != nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+				return fmt.Errorf("setting niceness to %d failed: %s", n, err)
+			}
+		}
+	}
 	return nil
 }
 
@@ -328,12 +1295,65 @@ type RuleBuildError struct {
 
 func (e RuleBuildError) Error() string { return e.Err.Error() }
 
+// Unwrap returns e.Err.
+func (e RuleBuildError) Unwrap() error { return e.Err }
+
+// A RecipeError means that one of a target's recipe commands failed.
+type RecipeError struct {
+	Target string
+
+	// Recipe is the expanded recipe command that failed.
+	Recipe string
+
+	// Index is the 1-based index of the recipe among the Count recipes
+	// that were selected to run (see SelectRecipes) for the target.
+	Index, Count int
+
+	// Err is the error from running the command, usually an
+	// *exec.ExitError.
+	Err error
+}
+
+func (e *RecipeError) Error() string {
+	return fmt.Sprintf("recipe %d of %d for target %s failed: %s (%s)", e.Index, e.Count, e.Target, e.Recipe, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *RecipeError) Unwrap() error { return e.Err }
+
+// A RecipeTimeoutError means that a recipe command was killed because it ran
+// longer than Config.RecipeTimeout. It is the Err of a RecipeError.
+type RecipeTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *RecipeTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s (Config.RecipeTimeout)", e.Timeout)
+}
+
+// A ForbiddenTargetError means that a target needed to build the goals is
+// forbidden by Config.AllowTargets or Config.DenyTargets.
+type ForbiddenTargetError struct {
+	Target string
+
+	// Pattern is the DenyTargets pattern that Target matched, or empty if
+	// Target didn't match any of the AllowTargets patterns.
+	Pattern string
+}
+
+func (e *ForbiddenTargetError) Error() string {
+	if e.Pattern != "" {
+		return fmt.Sprintf("building target %q is forbidden (it matches denied pattern %q)", e.Target, e.Pattern)
+	}
+	return fmt.Sprintf("building target %q is forbidden (it matches no allowed pattern)", e.Target)
+}
+
 func errNoRuleToMakeTarget(target string) error {
 	return fmt.Errorf("no rule to make target %q", target)
 }
 
-func errCircularDependency(target string, deps []string) error {
-	return fmt.Errorf("circular dependency for target %q: %v", target, deps)
+func errCircularDependency(target string, path []string) error {
+	return fmt.Errorf("circular dependency for target %q: %s", target, strings.Join(path, " -> "))
 }
 
 type nopCloser struct {
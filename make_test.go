@@ -1,12 +1,18 @@
 package makex
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,6 +31,41 @@ func TestMaker_DryRun(t *testing.T) {
 	}
 }
 
+func TestMaker_DryRun_recipes(t *testing.T) {
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{"x.c": ""}))}
+	mf, err := Parse([]byte(`
+CC = cc
+.PHONY: all
+all: x.o
+	echo done $$HOME
+
+x.o: x.c
+	$(CC) -c -o $@ $<
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, "all")
+	var buf bytes.Buffer
+	if err := mk.DryRun(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `========= TARGET SET 0 (1 targets)
+ -  x.o
+	cc -c -o x.o x.c
+
+========= TARGET SET 1 (1 targets)
+ -  all
+	echo done $HOME
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got output\n%s\nwant\n%s", got, want)
+	}
+	if isFile(conf.FS, "x.o") {
+		t.Error("DryRun built x.o; want it to run no recipes")
+	}
+}
+
 func TestMaker_Run(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "makex")
 	if err != nil {
@@ -197,6 +238,63 @@ func TestTargetsNeedingBuild(t *testing.T) {
 			goals: []string{"x", "y"},
 			wantTargetSetsNeedingBuild: [][]string{{"x"}},
 		},
+		"build target whose prereq target will be rebuilt": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+				&BasicRule{TargetFile: "y", PrereqFiles: []string{"z"}},
+			}},
+			fs: newModTimeFileSystem(rwvfs.Map(map[string]string{
+				"x": "", "y": "", "z": "",
+			})),
+			afterMake: func(fs FileSystem) error {
+				w, err := fs.Create("z")
+				if err != nil {
+					return err
+				}
+				return w.Close()
+			},
+			goals: []string{"x"},
+			wantTargetSetsNeedingBuild: [][]string{{"y"}, {"x"}},
+		},
+		"build target whose prereq target doesn't exist": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}},
+				&BasicRule{TargetFile: "y"},
+			}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x": ""})),
+			goals: []string{"x"},
+			wantTargetSetsNeedingBuild: [][]string{{"y"}, {"x"}},
+		},
+		"build target whose stale input changed": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "x", StaleInputFiles: []string{"x.conf", "missing.conf"}},
+				&BasicRule{TargetFile: "y", StaleInputFiles: []string{"y.conf"}},
+			}},
+			fs: newModTimeFileSystem(rwvfs.Map(map[string]string{
+				"x": "", "x.conf": "", "y": "", "y.conf": "",
+			})),
+			afterMake: func(fs FileSystem) error {
+				w, err := fs.Create("x.conf")
+				if err != nil {
+					return err
+				}
+				return w.Close()
+			},
+			goals: []string{"x", "y"},
+			wantTargetSetsNeedingBuild: [][]string{{"x"}},
+		},
+		"build target with a missing output": {
+			mf:    &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", OutputFiles: []string{"x2"}}}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x": ""})),
+			goals: []string{"x"},
+			wantTargetSetsNeedingBuild: [][]string{{"x"}},
+		},
+		"don't build target whose outputs all exist": {
+			mf:    &Makefile{Rules: []Rule{WithOutputs(&BasicRule{TargetFile: "x"}, "x2")}},
+			fs:    NewFileSystem(rwvfs.Map(map[string]string{"x": "", "x2": ""})),
+			goals: []string{"x"},
+			wantTargetSetsNeedingBuild: [][]string{},
+		},
 		"build targets recursively that don't exist": {
 			mf: &Makefile{Rules: []Rule{
 				&BasicRule{TargetFile: "x0", PrereqFiles: []string{"x1"}},
@@ -261,7 +359,7 @@ func TestTargetsNeedingBuild(t *testing.T) {
 			}},
 			fs:      NewFileSystem(rwvfs.Map(map[string]string{})),
 			goals:   []string{"x0"},
-			wantErr: errCircularDependency("x0", []string{"x0"}),
+			wantErr: errCircularDependency("x0", []string{"x0", "x0"}),
 		},
 		"detect 2-cycles": {
 			mf: &Makefile{Rules: []Rule{
@@ -270,7 +368,29 @@ func TestTargetsNeedingBuild(t *testing.T) {
 			}},
 			fs:      NewFileSystem(rwvfs.Map(map[string]string{})),
 			goals:   []string{"x0"},
-			wantErr: errCircularDependency("x0", []string{"x1"}),
+			wantErr: errCircularDependency("x0", []string{"x0", "x1", "x0"}),
+		},
+		"detect 3-cycles": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "x0", PrereqFiles: []string{"a", "x1"}},
+				&BasicRule{TargetFile: "x1", PrereqFiles: []string{"x2"}},
+				&BasicRule{TargetFile: "x2", PrereqFiles: []string{"x0", "x1"}},
+				&BasicRule{TargetFile: "a"},
+			}},
+			fs:      NewFileSystem(rwvfs.Map(map[string]string{})),
+			goals:   []string{"x0"},
+			wantErr: errCircularDependency("x0", []string{"x0", "x1", "x2", "x0"}),
+		},
+		"detect cycles in prereqs": {
+			mf: &Makefile{Rules: []Rule{
+				&BasicRule{TargetFile: "all", PrereqFiles: []string{"x0"}},
+				&BasicRule{TargetFile: "x0", PrereqFiles: []string{"x1"}},
+				&BasicRule{TargetFile: "x1", PrereqFiles: []string{"x2"}},
+				&BasicRule{TargetFile: "x2", PrereqFiles: []string{"x1"}},
+			}},
+			fs:      NewFileSystem(rwvfs.Map(map[string]string{})),
+			goals:   []string{"all"},
+			wantErr: errCircularDependency("all", []string{"all", "x0", "x1", "x2", "x1"}),
 		},
 		"re-build .PHONY target": {
 			mf: &Makefile{Rules: []Rule{
@@ -328,3 +448,580 @@ func TestTargetsNeedingBuild(t *testing.T) {
 		}
 	}
 }
+
+func TestMaker_ExplainUpToDate(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"all"}},
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"x1"}},
+		&BasicRule{TargetFile: "y"},
+		&BasicRule{TargetFile: "z"},
+	}}
+	fs := newModTimeFileSystem(rwvfs.Map(map[string]string{"x": "", "x1": "", "y": ""}))
+	conf := &Config{FS: fs}
+	mk := conf.NewMaker(mf, "all")
+
+	tests := map[string]string{
+		"all": "all is not up to date: all is phony, so it is always built",
+		"x":   "x is newer than all prereqs (newest prereq x1 at 0001-01-01T00:00:00Z)",
+		"y":   "y exists and has no prereqs",
+		"z":   "z is not up to date: z does not exist",
+	}
+	for target, want := range tests {
+		got, err := mk.ExplainUpToDate(target)
+		if err != nil {
+			t.Errorf("%s: ExplainUpToDate: %s", target, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got explanation %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestMaker_RecipeGroups(t *testing.T) {
+	mf, err := Parse([]byte(`
+x.o: x.c
+	cc -c -o $@ $<
+y.o: y.c
+	cc -c -o $@ $<
+z:
+	touch z
+install:
+	go install ./...
+deploy: build
+	echo build done
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	groups := conf.NewMaker(mf).RecipeGroups()
+	// Recipes are grouped by their text as written, even where it
+	// mentions a target's or prereq's name.
+	want := map[string][]string{
+		"cc -c -o $@ $<":   {"x.o", "y.o"},
+		"touch z":          {"z"},
+		"go install ./...": {"install"},
+		"echo build done":  {"deploy"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got recipe groups %v, want %v", groups, want)
+	}
+}
+
+func TestMaker_Run_errorOrder(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 3,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: "all", PrereqFiles: []string{"x0", "x1", "x2"}},
+			&BasicRule{TargetFile: "x2", RecipeCmds: []string{"false"}},
+			&BasicRule{TargetFile: "x0", RecipeCmds: []string{"sleep 0.1; false"}},
+			&BasicRule{TargetFile: "x1", RecipeCmds: []string{"false"}},
+		},
+	}
+	err := conf.NewMaker(mf, "all").Run()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("got error %v (%T), want Errors", err, err)
+	}
+	var targets []string
+	for _, err := range errs {
+		targets = append(targets, err.(RuleBuildError).Rule.Target())
+	}
+	if want := []string{"x0", "x1", "x2"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("got failed targets %v, want %v", targets, want)
+	}
+}
+
+func TestMaker_Run_recipeError(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{"true", "exit 3", "true"}},
+		},
+	}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	err := mk.Run()
+	var recipeErr *RecipeError
+	if !errors.As(err, &recipeErr) {
+		t.Fatalf("got error %v (%T), want it to contain a *RecipeError", err, err)
+	}
+	if recipeErr.Target != "x" || recipeErr.Recipe != "exit 3" || recipeErr.Index != 2 || recipeErr.Count != 3 {
+		t.Errorf("got RecipeError %+v, want recipe 2 of 3 (exit 3) for target x", recipeErr)
+	}
+	if want := "recipe 2 of 3 for target x failed: exit 3 (exit status 3)"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
+
+func TestMaker_Run_maxEchoLines(t *testing.T) {
+	var logBuf bytes.Buffer
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Verbose:      true,
+		MaxEchoLines: 2,
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{"true 1", "true 2", "true 3", "true 4"}},
+		},
+	}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(&logBuf, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := "running command: true 1\nrunning command: true 2\n... (2 more lines)\n"
+	if got := logBuf.String(); got != want {
+		t.Errorf("got log %q, want %q", got, want)
+	}
+}
+
+func TestMaker_Run_missingOutput(t *testing.T) {
+	mf := &Makefile{
+		Rules: []Rule{&BasicRule{TargetFile: "x", RecipeCmds: []string{"true"}}},
+	}
+	for _, strict := range []bool{false, true} {
+		var logBuf bytes.Buffer
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+			Strict:       strict,
+		}
+		mk := conf.NewMaker(mf, "x")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(&logBuf, "", 0)
+		}
+		err := mk.Run()
+		if strict && err == nil {
+			t.Error("strict: got no error for recipe that didn't create its target")
+		}
+		if !strict {
+			if err != nil {
+				t.Errorf("non-strict: Run: %s", err)
+			}
+			if want := "warning: recipes succeeded but did not create x\n"; logBuf.String() != want {
+				t.Errorf("non-strict: got log %q, want %q", logBuf.String(), want)
+			}
+		}
+	}
+}
+
+func TestMaker_Run_phonyTargetFile(t *testing.T) {
+	// A stray file named like a phony target doesn't keep the target from
+	// being built, and isn't removed when the target's recipes fail.
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"test": "stray"}))
+	calls := 0
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           fs,
+		Builtins: map[string]func(Rule, []string) error{
+			"fail": func(Rule, []string) error {
+				calls++
+				return errors.New("tests failed")
+			},
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"test"}},
+		&BasicRule{TargetFile: "test", RecipeCmds: []string{"@makex:call fail"}},
+	}}
+	mk := conf.NewMaker(mf, "test")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err == nil {
+		t.Error("got no error from failed recipe")
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls of phony target's recipe, want 1", calls)
+	}
+	if !isFile(fs, "test") {
+		t.Error("file named like the phony target was removed")
+	}
+}
+
+func TestMaker_RebuildOnMakefileChange(t *testing.T) {
+	mf := &Makefile{
+		Rules:   []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"x1"}}},
+		Sources: []string{"Makefile"},
+	}
+	fs := newModTimeFileSystem(rwvfs.Map(map[string]string{"x": "", "x1": "", "Makefile": ""}))
+	w, err := fs.Create("Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	for _, rebuild := range []bool{false, true} {
+		conf := &Config{FS: fs, RebuildOnMakefileChange: rebuild}
+		targetSets, err := conf.NewMaker(mf, "x").TargetSetsNeedingBuild()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale := len(targetSets) > 0; stale != rebuild {
+			t.Errorf("RebuildOnMakefileChange=%v: got stale %v after makefile changed, want %v", rebuild, stale, rebuild)
+		}
+	}
+}
+
+func TestNewMaker_limits(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", PrereqFiles: []string{"y", "z"}, RecipeCmds: []string{"a", "b"}},
+		&BasicRule{TargetFile: "y"},
+		&BasicRule{TargetFile: "z", RecipeCmds: []string{"a", "b", "c"}},
+	}}
+	tests := map[string]struct {
+		conf    Config
+		wantErr string
+	}{
+		"no limits":              {},
+		"within limits":          {conf: Config{MaxTargets: 3, MaxRecipesPerRule: 3}},
+		"too many targets":       {conf: Config{MaxTargets: 2}, wantErr: "goals have more than 2 targets (Config.MaxTargets)"},
+		"rule with many recipes": {conf: Config{MaxRecipesPerRule: 2}, wantErr: `target "z" has 3 recipes, more than 2 (Config.MaxRecipesPerRule)`},
+	}
+	for label, test := range tests {
+		test.conf.FS = NewFileSystem(rwvfs.Map(map[string]string{}))
+		_, err := test.conf.NewMaker(mf, "x").TargetSetsNeedingBuild()
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: TargetSetsNeedingBuild: %s", label, err)
+			}
+		} else if err == nil || err.Error() != test.wantErr {
+			t.Errorf("%s: got error %v, want %q", label, err, test.wantErr)
+		}
+	}
+}
+
+func TestNewMaker_allowDenyTargets(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"build", "deploy-prod"}},
+		&BasicRule{TargetFile: "build", PrereqFiles: []string{"main.go"}},
+		&BasicRule{TargetFile: "deploy-prod"},
+	}}
+	tests := map[string]struct {
+		conf    Config
+		goal    string
+		wantErr error
+	}{
+		"no restrictions":     {goal: "all"},
+		"denied prereq":       {conf: Config{DenyTargets: []string{"deploy-*"}}, goal: "all", wantErr: &ForbiddenTargetError{Target: "deploy-prod", Pattern: "deploy-*"}},
+		"denied goal":         {conf: Config{DenyTargets: []string{"deploy-*"}}, goal: "deploy-prod", wantErr: &ForbiddenTargetError{Target: "deploy-prod", Pattern: "deploy-*"}},
+		"not denied":          {conf: Config{DenyTargets: []string{"deploy-*"}}, goal: "build"},
+		"allowed":             {conf: Config{AllowTargets: []string{"all", "build", "deploy-*"}}, goal: "all"},
+		"not allowed":         {conf: Config{AllowTargets: []string{"all", "build"}}, goal: "all", wantErr: &ForbiddenTargetError{Target: "deploy-prod"}},
+		"allowed but denied":  {conf: Config{AllowTargets: []string{"*"}, DenyTargets: []string{"deploy-prod"}}, goal: "all", wantErr: &ForbiddenTargetError{Target: "deploy-prod", Pattern: "deploy-prod"}},
+		"prereq without rule": {conf: Config{AllowTargets: []string{"build"}}, goal: "build"},
+	}
+	for label, test := range tests {
+		test.conf.FS = NewFileSystem(rwvfs.Map(map[string]string{}))
+		_, err := test.conf.NewMaker(mf, test.goal).TargetSetsNeedingBuild()
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", label, err, test.wantErr)
+		}
+	}
+}
+
+func TestMaker_RunTagged(t *testing.T) {
+	var built []string
+	var mu sync.Mutex
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Builtins: map[string]func(Rule, []string) error{
+			"record": func(rule Rule, _ []string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				built = append(built, rule.Target())
+				return nil
+			},
+		},
+	}
+	mf, err := Parse([]byte(`
+.PHONY: all unit integration gen lint
+all: unit integration lint
+
+#makex:tags=fast
+unit: gen
+	@makex:call record
+
+#makex:tags=slow
+integration: gen
+	@makex:call record
+
+gen:
+	@makex:call record
+
+#makex:tags=fast,static
+lint:
+	@makex:call record
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.RunTagged("fast"); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(built)
+	if want := []string{"gen", "lint", "unit"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("got built %v, want %v", built, want)
+	}
+
+	built = nil
+	if err := mk.RunTagged("nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	if len(built) != 0 {
+		t.Errorf("got built %v for unused tag, want none", built)
+	}
+}
+
+func TestMaker_Run_lockGroups(t *testing.T) {
+	var running, maxRunning int32
+	var mu sync.Mutex
+	conf := &Config{
+		ParallelJobs: 4,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		LockGroups: func(r Rule) string {
+			if strings.HasPrefix(r.Target(), "index") {
+				return "index"
+			}
+			return ""
+		},
+		Builtins: map[string]func(Rule, []string) error{
+			"work": func(r Rule, _ []string) error {
+				if strings.HasPrefix(r.Target(), "index") {
+					n := atomic.AddInt32(&running, 1)
+					defer atomic.AddInt32(&running, -1)
+					mu.Lock()
+					if n > maxRunning {
+						maxRunning = n
+					}
+					mu.Unlock()
+				}
+				time.Sleep(20 * time.Millisecond)
+				return nil
+			},
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"index1", "index2", "index3", "other"}},
+		&BasicRule{TargetFile: "index1", RecipeCmds: []string{"@makex:call work"}},
+		&BasicRule{TargetFile: "index2", RecipeCmds: []string{"@makex:call work"}},
+		&BasicRule{TargetFile: "index3", RecipeCmds: []string{"@makex:call work"}},
+		&BasicRule{TargetFile: "other", RecipeCmds: []string{"@makex:call work"}},
+	}}
+	if err := conf.NewMaker(mf, "index1", "index2", "index3", "other").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning != 1 {
+		t.Errorf("got %d targets in the same lock group running concurrently, want 1", maxRunning)
+	}
+}
+
+func TestMaker_Run_buildRetries(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"@makex:call flaky"}},
+	}}
+	tests := map[string]struct {
+		failures  int
+		transient bool
+		wantCalls int
+		wantErr   bool
+	}{
+		"transient error":           {failures: 1, transient: true, wantCalls: 2},
+		"too many transient errors": {failures: 3, transient: true, wantCalls: 3, wantErr: true},
+		"non-transient error":       {failures: 1, wantCalls: 1, wantErr: true},
+	}
+	for label, test := range tests {
+		calls := 0
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+			BuildRetries: 2,
+			TransientError: func(err error) bool {
+				return test.transient && strings.Contains(err.Error(), "connection reset")
+			},
+			Builtins: map[string]func(Rule, []string) error{
+				"flaky": func(Rule, []string) error {
+					calls++
+					if calls <= test.failures {
+						return errors.New("connection reset")
+					}
+					return nil
+				},
+			},
+			Log: log.New(ioutil.Discard, "", 0),
+		}
+		mk := conf.NewMaker(mf, "x")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		err := mk.Run()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", label, err, test.wantErr)
+		}
+		if calls != test.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", label, calls, test.wantCalls)
+		}
+	}
+}
+
+func TestMaker_Run_keepGoing(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"all", "a", "b", "c", "d", "e"}},
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"d", "e"}},
+		&BasicRule{TargetFile: "a", RecipeCmds: []string{"@makex:call fail"}},
+		&BasicRule{TargetFile: "b", RecipeCmds: []string{"@makex:call ok"}},
+		&BasicRule{TargetFile: "c", PrereqFiles: []string{"a"}, RecipeCmds: []string{"@makex:call ok"}},
+		&BasicRule{TargetFile: "d", PrereqFiles: []string{"c"}, RecipeCmds: []string{"@makex:call ok"}},
+		&BasicRule{TargetFile: "e", PrereqFiles: []string{"b"}, RecipeCmds: []string{"@makex:call ok"}},
+	}}
+	tests := map[bool]map[string]TargetStatus{
+		false: {"all": TargetNotBuilt, "a": TargetFailed, "b": TargetBuilt, "c": TargetNotBuilt, "d": TargetNotBuilt, "e": TargetNotBuilt},
+		true:  {"all": TargetPrereqFailed, "a": TargetFailed, "b": TargetBuilt, "c": TargetPrereqFailed, "d": TargetPrereqFailed, "e": TargetBuilt},
+	}
+	for keepGoing, wantStatuses := range tests {
+		var logBuf bytes.Buffer
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+			KeepGoing:    keepGoing,
+			Log:          log.New(&logBuf, "", 0),
+			Builtins: map[string]func(Rule, []string) error{
+				"ok":   func(Rule, []string) error { return nil },
+				"fail": func(Rule, []string) error { return errors.New("failed") },
+			},
+		}
+		mk := conf.NewMaker(mf, "all")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		err := mk.Run()
+		errs, ok := err.(Errors)
+		if !ok || len(errs) != 1 || errs[0].(RuleBuildError).Rule.Target() != "a" {
+			t.Errorf("keepGoing=%v: got error %v, want Errors with a's error", keepGoing, err)
+		}
+		if statuses := mk.Result().Statuses; !reflect.DeepEqual(statuses, wantStatuses) {
+			t.Errorf("keepGoing=%v: got statuses %v, want %v", keepGoing, statuses, wantStatuses)
+		}
+		if keepGoing && !strings.Contains(logBuf.String(), "not building c because its prereq a failed") {
+			t.Errorf("keepGoing=%v: got log %q, want it to mention that c was skipped", keepGoing, logBuf.String())
+		}
+	}
+}
+
+func TestMaker_ValidateRecipes(t *testing.T) {
+	mf, err := Parse([]byte(`
+CC = cc
+.PHONY: all
+all: a b c
+a:
+	$(CC) -o $@ $(shell exit 1)
+b:
+	$(patsubst %.c,%.o,x.c)
+	echo $*
+c:
+	echo $(UNDEFINED_IN_MAKEFILE_OR_ENV
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{}))}
+	err = conf.NewMaker(mf, "all").ValidateRecipes()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("got error %v, want Errors", err)
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.(RuleBuildError).Rule.Target()+": "+err.Error())
+	}
+	want := []string{
+		`b: expanding recipe failed: $(patsubst %.c,%.o,x.c) (unknown function "patsubst")`,
+		`b: expanding recipe failed: echo $* (undefined variable "*")`,
+		`c: expanding recipe failed: echo $(UNDEFINED_IN_MAKEFILE_OR_ENV (unterminated variable reference in "echo $(UNDEFINED_IN_MAKEFILE_OR_ENV")`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got errors\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMaker_Run_atomicTargets(t *testing.T) {
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"y": "old"}))
+	var gotPaths []string
+	conf := &Config{
+		ParallelJobs:  1,
+		FS:            fs,
+		AtomicTargets: true,
+		Builtins: map[string]func(Rule, []string) error{
+			"write": func(_ Rule, args []string) error {
+				gotPaths = append(gotPaths, args[0])
+				w, err := fs.Create(args[0])
+				if err != nil {
+					return err
+				}
+				io.WriteString(w, args[1])
+				w.Close()
+				if len(args) > 2 {
+					return errors.New(args[2])
+				}
+				return nil
+			},
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"force"}},
+		&BasicRule{TargetFile: "force"},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"@makex:call write x new"}},
+		&BasicRule{TargetFile: "y", PrereqFiles: []string{"force"}, RecipeCmds: []string{"@makex:call write y partial fail"}},
+	}}
+	mk := conf.NewMaker(mf, "x", "y")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err == nil {
+		t.Error("got no error from failed recipe")
+	}
+
+	sort.Strings(gotPaths)
+	if want := []string{".x.makex-staging", ".y.makex-staging"}; !reflect.DeepEqual(gotPaths, want) {
+		t.Errorf("got recipes writing to %v, want %v", gotPaths, want)
+	}
+	for path, want := range map[string]string{"x": "new", "y": "old"} {
+		f, err := fs.Open(path)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", path, data, want)
+		}
+	}
+	for _, path := range gotPaths {
+		if exists, _ := conf.pathExists(path); exists {
+			t.Errorf("staging file %s was not removed", path)
+		}
+	}
+}
@@ -2,18 +2,48 @@ package makex
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
+	"io"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"sourcegraph.com/sourcegraph/rwvfs"
 )
 
-// Makefile represents a set of rules, each describing how to build a target.
+// Makefile represents a set of rules, each describing how to build a target,
+// and the variables that the rules' recipes may reference.
 type Makefile struct {
 	Rules []Rule
+
+	// Vars maps variable names to their definitions. Recipes' references
+	// to variables (and function calls, such as "$(shell date)") are
+	// expanded when the recipes are run, if the makefile was parsed or
+	// Vars is non-nil. Otherwise, only the automatic variables (see
+	// ExpandAutoVars) in recipes are expanded, and the recipes are
+	// otherwise run as is, so that recipes written for the shell (such as
+	// "echo $(date)") keep their meaning.
+	Vars map[string]*Var
+
+	// Sources are the paths of the files that the makefile was parsed
+	// from, if known. See Config.RebuildOnMakefileChange.
+	Sources []string
+
+	// ParseDuration is how long it took to parse the makefile (and, for a
+	// makefile returned by Config.Expand, to expand it).
+	ParseDuration time.Duration
+
+	// parsed is whether the makefile was returned by Parse (or expanded
+	// from one that was).
+	parsed bool
+}
+
+// expandsVars reports whether the makefile's recipes' references to
+// variables are expanded (see Vars).
+func (mf *Makefile) expandsVars() bool {
+	return mf.parsed || mf.Vars != nil
 }
 
 // BasicRule implements Rule.
@@ -26,6 +56,29 @@ type BasicRule struct {
 	TargetFile  string
 	PrereqFiles []string
 	RecipeCmds  []string
+
+	// OutputFiles are files produced by the recipes in addition to
+	// TargetFile.
+	OutputFiles []string
+
+	// StaleInputFiles are files that the recipes read that aren't
+	// prereqs (see StaleInputsRule).
+	StaleInputFiles []string
+
+	// Service is whether TargetFile is a service (see ServiceRule).
+	Service bool
+
+	// TagNames are the rule's tags (see TagsRule).
+	TagNames []string
+
+	// Once is whether the rule's recipes run at most once per build (see
+	// RunOnceRule).
+	Once bool
+
+	// RecipeSourceCmds are the recipes as they were written in the
+	// makefile, before Parse expanded their automatic variables (see
+	// RecipeSourcesRule). It is nil if they are the same as RecipeCmds.
+	RecipeSourceCmds []string
 }
 
 // Target implements Rule.
@@ -37,17 +90,88 @@ func (r *BasicRule) Prereqs() []string { return r.PrereqFiles }
 // Recipes implements rule.
 func (r *BasicRule) Recipes() []string { return r.RecipeCmds }
 
+// RecipeSources implements RecipeSourcesRule.
+func (r *BasicRule) RecipeSources() []string {
+	if r.RecipeSourceCmds == nil {
+		return r.RecipeCmds
+	}
+	return r.RecipeSourceCmds
+}
+
+// IsService implements ServiceRule.
+func (r *BasicRule) IsService() bool { return r.Service }
+
+// Outputs implements OutputsRule.
+func (r *BasicRule) Outputs() []string {
+	return appendOutputs([]string{r.TargetFile}, r.OutputFiles)
+}
+
+// StaleInputs implements StaleInputsRule.
+func (r *BasicRule) StaleInputs() []string { return r.StaleInputFiles }
+
+// Tags implements TagsRule.
+func (r *BasicRule) Tags() []string { return r.TagNames }
+
+// RunOnce implements RunOnceRule.
+func (r *BasicRule) RunOnce() bool { return r.Once }
+
 // Rule returns the rule to make the specified target if it exists, or nil
 // otherwise.
 //
+// If no rule's target is exactly target, Rule looks for a template rule: a
+// rule whose target contains "{name}" placeholders, such as
+// "build-{os}-{arch}". If target matches the template (e.g.,
+// "build-linux-amd64"), Rule returns a new rule for target whose prereqs,
+// outputs, and recipes have each "{name}" replaced with the text that the
+// placeholder matched. In parsed makefiles, the captured values are also
+// available to the recipes as variables (e.g., "$(os)" and "$(arch)"). Each
+// placeholder matches 1 or more characters; if a target matches a template in
+// more than one way, the earlier placeholders match as few characters as
+// possible.
+//
+// Rule also looks for pattern rules, as in GNU make: a rule whose target
+// contains a "%", such as "%.o". If target matches the pattern (e.g.,
+// "dir/x.o"), the "%" matches 1 or more characters (the stem, "dir/x"), and
+// Rule returns a new rule for target whose prereqs and outputs have their
+// first "%" replaced with the stem. The recipes are unchanged, but their
+// automatic variables ("$@", "$<", and "$^") refer to the new rule's target
+// and prereqs, and "$*" is the stem. Match-anything pattern rules (whose
+// target is just "%") are ignored, because they would also match their own
+// prereqs.
+//
+// Template and pattern rules are only used if no rule's target is exactly
+// target, and they are tried in the order they appear in the makefile. Rule
+// doesn't check the filesystem, but a Maker only uses a pattern rule for a
+// target if each of the new rule's prereqs exists or can be made (as in GNU
+// make), so that, for example, an existing "lib.o" isn't rebuilt by a "%.o:
+// %.c" rule when there is no "lib.c".
+//
 // TODO(sqs): support multiple rules for one target
 // (http://www.gnu.org/software/make/manual/html_node/Multiple-Rules.html).
 func (mf *Makefile) Rule(target string) Rule {
+	return mf.rule(target, nil)
+}
+
+// rule is like Rule, but it skips the rules instantiated from pattern rules
+// that usable (if non-nil) reports can't be used.
+func (mf *Makefile) rule(target string, usable func(Rule) bool) Rule {
 	for _, rule := range mf.Rules {
 		if rule.Target() == target {
 			return rule
 		}
 	}
+	for _, rule := range mf.Rules {
+		switch t := rule.Target(); {
+		case isTemplate(t):
+			if r := instantiate(rule, target); r != nil {
+				return r
+			}
+		case isPattern(t) && t != "%":
+			if r := instantiatePattern(rule, target); r != nil && (usable == nil || usable(r)) {
+				return r
+			}
+		}
+	}
 	return nil
 }
 
@@ -64,12 +188,144 @@ type Rule interface {
 	Recipes() []string
 }
 
-// DefaultRule is the first rule whose name does not begin with a ".", or nil if
-// no such rule exists.
+// An OutputsRule is a Rule whose recipes produce other files in addition to
+// its target. A target is stale if any of its outputs is missing or older
+// than a prereq, and all of its outputs are removed if its recipes fail.
+type OutputsRule interface {
+	Rule
+
+	// Outputs returns all files produced by the rule's recipes,
+	// including the target.
+	Outputs() []string
+}
+
+// A StaleInputsRule is a Rule whose recipes read files that aren't prereqs
+// (such as configuration files that exist outside of the build), but that
+// should cause the target to be rebuilt when they change. A target is stale
+// if any of its stale inputs is newer than its outputs, but stale inputs are
+// otherwise not treated as prereqs: they are never built, and they are not
+// included in "$^" or "$<". Stale inputs that don't exist are ignored.
+type StaleInputsRule interface {
+	Rule
+
+	StaleInputs() []string
+}
+
+// staleInputs returns rule's stale inputs, if it is a StaleInputsRule.
+func staleInputs(rule Rule) []string {
+	if r, ok := rule.(StaleInputsRule); ok {
+		return r.StaleInputs()
+	}
+	return nil
+}
+
+// A TagsRule is a Rule with tags, which are arbitrary names (such as "fast" or
+// "unit") used to select a subset of targets to build (see Maker.RunTagged).
+type TagsRule interface {
+	Rule
+
+	Tags() []string
+}
+
+// ruleTags returns rule's tags, if it is a TagsRule.
+func ruleTags(rule Rule) []string {
+	if r, ok := rule.(TagsRule); ok {
+		return r.Tags()
+	}
+	return nil
+}
+
+// hasTag reports whether rule has the tag.
+func hasTag(rule Rule, tag string) bool {
+	for _, t := range ruleTags(rule) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// A RecipeSourcesRule is a Rule whose recipes were produced from source text
+// (such as by Parse, which expands the automatic variables in a makefile's
+// recipes). RecipeSources returns the source text of each of the rule's
+// recipes.
+type RecipeSourcesRule interface {
+	Rule
+
+	RecipeSources() []string
+}
+
+// recipeSources returns the source text of rule's recipes, which is the
+// recipes themselves unless rule is a RecipeSourcesRule.
+func recipeSources(rule Rule) []string {
+	if r, ok := rule.(RecipeSourcesRule); ok {
+		return r.RecipeSources()
+	}
+	return rule.Recipes()
+}
+
+// recipeSourceCmds returns the source text of rule's recipes, or nil if it is
+// the same as the recipes (see BasicRule.RecipeSourceCmds).
+func recipeSourceCmds(rule Rule) []string {
+	recipes, sources := rule.Recipes(), recipeSources(rule)
+	if len(sources) != len(recipes) {
+		return sources
+	}
+	for i, source := range sources {
+		if source != recipes[i] {
+			return sources
+		}
+	}
+	return nil
+}
+
+// WithOutputs returns a Rule that behaves like rule but also declares that its
+// recipes produce outputs (in addition to its target and any outputs that
+// rule already declares).
+func WithOutputs(rule Rule, outputs ...string) Rule {
+	return &outputsRule{rule, appendOutputs(ruleOutputs(rule), outputs)}
+}
+
+type outputsRule struct {
+	Rule
+	outputs []string
+}
+
+func (r *outputsRule) Outputs() []string { return r.outputs }
+
+// ruleOutputs returns the files produced by rule: its target, followed by its
+// declared outputs (if rule is an OutputsRule).
+func ruleOutputs(rule Rule) []string {
+	outputs := []string{rule.Target()}
+	if r, ok := rule.(OutputsRule); ok {
+		outputs = appendOutputs(outputs, r.Outputs())
+	}
+	return outputs
+}
+
+// appendOutputs appends the outputs that aren't already in dst to dst.
+func appendOutputs(dst []string, outputs []string) []string {
+	for _, output := range outputs {
+		present := false
+		for _, o := range dst {
+			if o == output {
+				present = true
+				break
+			}
+		}
+		if !present {
+			dst = append(dst, output)
+		}
+	}
+	return dst
+}
+
+// DefaultRule is the first rule whose name does not begin with a "." and that
+// isn't a template or pattern rule (see Rule), or nil if no such rule exists.
 func (mf *Makefile) DefaultRule() Rule {
 	for _, rule := range mf.Rules {
 		target := rule.Target()
-		if !strings.HasPrefix(target, ".") {
+		if !strings.HasPrefix(target, ".") && !isTemplate(target) && !isPattern(target) {
 			return rule
 		}
 	}
@@ -81,22 +337,80 @@ func (mf *Makefile) DefaultRule() Rule {
 //
 // Only globs containing "*" are detected.
 func (c *Config) Expand(orig *Makefile) (*Makefile, error) {
-	var mf Makefile
+	start := time.Now()
+	mf := Makefile{Vars: orig.Vars, Sources: orig.Sources, parsed: orig.parsed}
 	mf.Rules = make([]Rule, len(orig.Rules))
 	for i, rule := range orig.Rules {
 		expandedPrereqs, err := c.globs(rule.Prereqs())
 		if err != nil {
 			return nil, err
 		}
+		expandedStaleInputs, err := c.globs(staleInputs(rule))
+		if err != nil {
+			return nil, err
+		}
 		mf.Rules[i] = &BasicRule{
-			TargetFile:  rule.Target(),
-			PrereqFiles: expandedPrereqs,
-			RecipeCmds:  rule.Recipes(),
+			TargetFile:      rule.Target(),
+			PrereqFiles:     expandedPrereqs,
+			RecipeCmds:      rule.Recipes(),
+			OutputFiles:     ruleOutputs(rule)[1:],
+			StaleInputFiles: expandedStaleInputs,
+			Service:         isService(rule),
+			TagNames:        ruleTags(rule),
+			Once:            isRunOnce(rule),
 		}
+		mf.Rules[i].(*BasicRule).RecipeSourceCmds = recipeSourceCmds(rule)
 	}
+	mf.ParseDuration = orig.ParseDuration + time.Since(start)
 	return &mf, nil
 }
 
+// A PrereqOrderDiff describes a rule whose prereqs (and therefore its
+// recipes' "$^" and "$<") were listed in a different order in two
+// expansions of the same makefile (see Config.PrereqOrderDiffs).
+type PrereqOrderDiff struct {
+	Target string
+
+	// Globs are the glob patterns in the rule's unexpanded prereqs, which
+	// are the likely cause of the difference.
+	Globs []string
+
+	// First and Second are the rule's prereqs in each expansion.
+	First, Second []string
+}
+
+// PrereqOrderDiffs calls Expand twice on mf and returns the rules whose prereqs
+// are in a different order in the two expansions. Such rules' recipes may
+// produce different output from run to run even if their inputs are the same,
+// usually because a glob in their prereqs matches files in a nondeterministic
+// order.
+func (c *Config) PrereqOrderDiffs(mf *Makefile) ([]PrereqOrderDiff, error) {
+	first, err := c.Expand(mf)
+	if err != nil {
+		return nil, err
+	}
+	second, err := c.Expand(mf)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []PrereqOrderDiff
+	for i, rule := range mf.Rules {
+		p1, p2 := first.Rules[i].Prereqs(), second.Rules[i].Prereqs()
+		if strings.Join(p1, "\x00") == strings.Join(p2, "\x00") {
+			continue
+		}
+		diff := PrereqOrderDiff{Target: rule.Target(), First: p1, Second: p2}
+		for _, p := range rule.Prereqs() {
+			if strings.ContainsAny(p, "*?[]") {
+				diff.Globs = append(diff.Globs, p)
+			}
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
 // globs returns all files in the filesystem that match any of the glob patterns
 // (using path/filepath.Match glob syntax). The
 func (c *Config) globs(patterns []string) (matches []string, err error) {
@@ -137,18 +451,146 @@ func globPrefix(path string) string {
 // ExpandAutoVars expands the automatic variables $@ (the current target path)
 // and $^ (the space-separated list of prereqs) in s.
 func ExpandAutoVars(rule Rule, s string) string {
-	s = strings.Replace(s, "$@", Quote(rule.Target()), -1)
-	s = strings.Replace(s, "$^", strings.Join(QuoteList(rule.Prereqs()), " "), -1)
+	if strings.IndexByte(s, '$') == -1 {
+		return s
+	}
 
-	var firstPrereq string
-	if len(rule.Prereqs()) > 0 {
-		firstPrereq = Quote(rule.Prereqs()[0])
+	if strings.Contains(s, "$@") {
+		s = strings.Replace(s, "$@", Quote(rule.Target()), -1)
+	}
+	if strings.Contains(s, "$^") {
+		s = strings.Replace(s, "$^", strings.Join(QuoteList(rule.Prereqs()), " "), -1)
+	}
+	if strings.Contains(s, "$<") {
+		var firstPrereq string
+		if len(rule.Prereqs()) > 0 {
+			firstPrereq = Quote(rule.Prereqs()[0])
+		}
+		s = strings.Replace(s, "$<", firstPrereq, -1)
 	}
-	s = strings.Replace(s, "$<", firstPrereq, -1)
 
 	return s
 }
 
+// TempFile returns a path that rule's recipes may use as a scratch file (it is
+// the value of "$(@TMP)" in recipes). Unlike names derived from the process ID,
+// it is the same every time the rule is run, as long as the rule's target,
+// prereqs, and recipes don't change, so it doesn't perturb the output of
+// recipes whose output depends on their intermediate files' names. It is in
+// the same directory as the target.
+func TempFile(rule Rule) string {
+	h := sha1.New()
+	io.WriteString(h, rule.Target())
+	for _, list := range [][]string{rule.Prereqs(), rule.Recipes()} {
+		h.Write([]byte{0})
+		for _, s := range list {
+			io.WriteString(h, s)
+			h.Write([]byte{0})
+		}
+	}
+	dir, base := filepath.Split(rule.Target())
+	return filepath.Join(dir, fmt.Sprintf(".%s.%x.tmp", base, h.Sum(nil)[:6]))
+}
+
+// replaceWord replaces occurrences of old in s with new, but only where old
+// is not adjacent to a character that isClean considers part of a file name.
+func replaceWord(s, old, new string) string {
+	if old == "" {
+		return s
+	}
+	var b []byte
+	last := 0
+	for i := 0; i+len(old) <= len(s); {
+		j := strings.Index(s[i:], old)
+		if j == -1 {
+			break
+		}
+		start, end := i+j, i+j+len(old)
+		if (start == 0 || !isClean(s[start-1:start])) && (end == len(s) || !isClean(s[end:end+1])) {
+			b = append(b, s[last:start]...)
+			b = append(b, new...)
+			last = end
+			i = end
+		} else {
+			i = start + 1
+		}
+	}
+	if b == nil {
+		return s
+	}
+	return string(append(b, s[last:]...))
+}
+
+// SelectRecipes returns the recipes that apply to the configured platform.
+//
+// A recipe line may be tagged with a platform marker: a "#" immediately
+// followed by a known GOOS ("#linux"), a known GOARCH ("#amd64"), or both
+// ("#linux/amd64"), and then a space and the command. Tagged lines are kept
+// (with the marker removed) only if the marker matches c.Platform. Untagged
+// lines, including ordinary comment lines such as "# comment", "#TODO fix",
+// and "#!/bin/sh", are always kept.
+func (c *Config) SelectRecipes(recipes []string) []string {
+	goos, goarch := c.platform()
+	selected := make([]string, 0, len(recipes))
+	for _, recipe := range recipes {
+		tag, cmd, tagged := platformTag(recipe)
+		if !tagged {
+			selected = append(selected, recipe)
+			continue
+		}
+		if tag == goos || tag == goarch || tag == goos+"/"+goarch {
+			selected = append(selected, cmd)
+		}
+	}
+	return selected
+}
+
+// platformTag splits a recipe line of the form "#tag cmd" into its tag and
+// command.
+func platformTag(recipe string) (tag, cmd string, tagged bool) {
+	if !strings.HasPrefix(recipe, "#") {
+		return "", recipe, false
+	}
+	end := strings.IndexAny(recipe, " \t")
+	if end == -1 {
+		end = len(recipe)
+	}
+	tag = recipe[1:end]
+	if !isPlatformTag(tag) {
+		return "", recipe, false
+	}
+	return tag, strings.TrimLeft(recipe[end:], " \t"), true
+}
+
+// isPlatformTag reports whether tag is a known GOOS, a known GOARCH, or a
+// known GOOS and GOARCH separated by a "/".
+func isPlatformTag(tag string) bool {
+	if i := strings.Index(tag, "/"); i != -1 {
+		return knownOS[tag[:i]] && knownArch[tag[i+1:]]
+	}
+	return knownOS[tag] || knownArch[tag]
+}
+
+// knownOS and knownArch are the GOOS and GOARCH values that Go knows about
+// (as listed in go/build's syslist.go).
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true,
+		"freebsd": true, "hurd": true, "illumos": true, "ios": true,
+		"js": true, "linux": true, "nacl": true, "netbsd": true,
+		"openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true,
+		"armbe": true, "arm64": true, "arm64be": true, "loong64": true,
+		"mips": true, "mipsle": true, "mips64": true, "mips64le": true,
+		"mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true,
+		"s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
 // Marshal returns the textual representation of the Makefile, in the
 // usual format:
 //
@@ -160,6 +602,19 @@ func ExpandAutoVars(rule Rule, s string) string {
 func Marshal(mf *Makefile) ([]byte, error) {
 	var b bytes.Buffer
 
+	if len(mf.Vars) > 0 {
+		for _, name := range sortedVarNames(mf.Vars) {
+			if v := mf.Vars[name]; v.Simple {
+				fmt.Fprintf(&b, "%s := %s\n", name, strings.Replace(v.Value, "$", "$$", -1))
+			} else {
+				fmt.Fprintf(&b, "%s = %s\n", name, v.Value)
+			}
+		}
+		if len(mf.Rules) > 0 {
+			fmt.Fprintln(&b)
+		}
+	}
+
 	for i, rule := range mf.Rules {
 		if i != 0 {
 			fmt.Fprintln(&b)
@@ -179,8 +634,6 @@ func Marshal(mf *Makefile) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-var cleanRE = regexp.MustCompile(`^[\w\d_/.-]+$`)
-
 // Quote IS NOT A SAFE WAY TO ESCAPE USER INPUT. It hackily escapes
 // special characters in s and surrounds it with quotation marks if
 // needed, so that the shell interprets it as a single argument equal
@@ -188,13 +641,30 @@ var cleanRE = regexp.MustCompile(`^[\w\d_/.-]+$`)
 //
 // TODO(sqs): come up with a safe way of escaping user input
 func Quote(s string) string {
-	if cleanRE.MatchString(s) {
+	if isClean(s) {
 		return s
 	}
 	q := strconv.Quote(s)
 	return "'" + strings.Replace(q[1:len(q)-1], "'", "", -1) + "'"
 }
 
+// isClean reports whether s is non-empty and consists only of characters
+// that the shell doesn't treat specially ([\w\d_/.-]).
+func isClean(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '_', c == '/', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // QuoteList IS NOT A SAFE WAY TO ESCAPE USER INPUT. It returns a list
 // whose elements are the escaped elements of ss (using Quote). DON'T
 // RELY ON THIS FOR SECURITY.
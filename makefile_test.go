@@ -1,31 +1,51 @@
 package makex
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
 )
 
 func TestMarshal(t *testing.T) {
 	tests := []struct {
 		rules    []Rule
+		vars     map[string]*Var
 		makefile string
 	}{
 		{
 			rules: []Rule{
 				&BasicRule{
-					"myTarget",
-					[]string{"myPrereq0", "myPrereq1"},
-					[]string{"foo bar"},
+					TargetFile:  "myTarget",
+					PrereqFiles: []string{"myPrereq0", "myPrereq1"},
+					RecipeCmds:  []string{"foo bar"},
 				},
 			},
 			makefile: `
 myTarget: myPrereq0 myPrereq1
 	foo bar
+`,
+		},
+		{
+			rules: []Rule{&BasicRule{TargetFile: "x", RecipeCmds: []string{"$(CC) -o $@"}}},
+			vars: map[string]*Var{
+				"CC":  {Value: "$(TOOLCHAIN)gcc"},
+				"PID": {Value: "$1", Simple: true},
+			},
+			makefile: `
+CC = $(TOOLCHAIN)gcc
+PID := $$1
+
+x:
+	$(CC) -o $@
 `,
 		},
 	}
 	for _, test := range tests {
-		makefile, err := Marshal(&Makefile{test.rules})
+		makefile, err := Marshal(&Makefile{Rules: test.rules, Vars: test.vars})
 		if err != nil {
 			t.Error(err)
 			continue
@@ -44,9 +64,9 @@ func TestExpandAutoVars(t *testing.T) {
 	}{
 		{
 			rule: &BasicRule{
-				"myTarget",
-				[]string{"myPrereq0", "myPrereq1"},
-				[]string{"foo bar"},
+				TargetFile:  "myTarget",
+				PrereqFiles: []string{"myPrereq0", "myPrereq1"},
+				RecipeCmds:  []string{"foo bar"},
 			},
 			input: "$@ : $^ : $<",
 			want:  "myTarget : myPrereq0 myPrereq1 : myPrereq0",
@@ -64,3 +84,97 @@ func TestExpandAutoVars(t *testing.T) {
 		}
 	}
 }
+
+func TestConfig_SelectRecipes(t *testing.T) {
+	recipes := []string{
+		"echo all",
+		"#linux echo linux",
+		"#darwin echo darwin",
+		"#arm64 echo arm64",
+		"#linux/amd64 echo linux-amd64",
+		"# a comment",
+		"#TODO remove this",
+		"#!/bin/sh",
+		"#linux/plan9 echo not a platform",
+	}
+	tests := []struct {
+		platform string
+		want     []string
+	}{
+		{
+			platform: "linux/amd64",
+			want:     []string{"echo all", "echo linux", "echo linux-amd64", "# a comment", "#TODO remove this", "#!/bin/sh", "#linux/plan9 echo not a platform"},
+		},
+		{
+			platform: "darwin/arm64",
+			want:     []string{"echo all", "echo darwin", "echo arm64", "# a comment", "#TODO remove this", "#!/bin/sh", "#linux/plan9 echo not a platform"},
+		},
+	}
+	for _, test := range tests {
+		conf := &Config{Platform: test.platform}
+		got := conf.SelectRecipes(recipes)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got recipes %q, want %q", test.platform, got, test.want)
+		}
+	}
+}
+
+func TestTempFile(t *testing.T) {
+	rule := &BasicRule{TargetFile: "out/x.o", PrereqFiles: []string{"x.c"}, RecipeCmds: []string{"cc -o $(@TMP) x.c"}}
+	tmp := TempFile(rule)
+	if dir := filepath.Dir(tmp); dir != "out" {
+		t.Errorf("got temp file %q in dir %q, want it in the target's dir", tmp, dir)
+	}
+	if again := TempFile(&BasicRule{TargetFile: "out/x.o", PrereqFiles: []string{"x.c"}, RecipeCmds: []string{"cc -o $(@TMP) x.c"}}); again != tmp {
+		t.Errorf("got temp file %q for identical rule, want %q", again, tmp)
+	}
+	if other := TempFile(&BasicRule{TargetFile: "out/x.o", PrereqFiles: []string{"x.c"}, RecipeCmds: []string{"cc -O2 -o $(@TMP) x.c"}}); other == tmp {
+		t.Errorf("got same temp file %q for rule with different recipes", other)
+	}
+
+	mk := (&Config{}).NewMaker(&Makefile{Rules: []Rule{rule}}, "out/x.o")
+	recipe, err := mk.expandRecipe(rule, rule.RecipeCmds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cc -o " + tmp + " x.c"; recipe != want {
+		t.Errorf("got expanded recipe %q, want %q", recipe, want)
+	}
+}
+
+// reversingFS lists directory entries in the opposite order on every other
+// call to ReadDir, to simulate a filesystem with nondeterministic ordering.
+type reversingFS struct {
+	FileSystem
+	calls *int
+}
+
+func (fs reversingFS) ReadDir(path string) ([]os.FileInfo, error) {
+	fis, err := fs.FileSystem.ReadDir(path)
+	*fs.calls++
+	if *fs.calls%2 == 0 {
+		for i, j := 0, len(fis)-1; i < j; i, j = i+1, j-1 {
+			fis[i], fis[j] = fis[j], fis[i]
+		}
+	}
+	return fis, err
+}
+
+func TestConfig_PrereqOrderDiffs(t *testing.T) {
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x.c", "y.c"}},
+		&BasicRule{TargetFile: "lib", PrereqFiles: []string{"src/*.c"}},
+	}}
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"src/a.c": "", "src/b.c": ""}))
+	conf := &Config{FS: reversingFS{fs, new(int)}}
+	diffs, err := conf.PrereqOrderDiffs(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1: %v", len(diffs), diffs)
+	}
+	if d := diffs[0]; d.Target != "lib" || !reflect.DeepEqual(d.Globs, []string{"src/*.c"}) || reflect.DeepEqual(d.First, d.Second) {
+		t.Errorf("got diff %+v, want diff for lib's glob", d)
+	}
+}
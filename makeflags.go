@@ -0,0 +1,151 @@
+package makex
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ApplyMakeFlags applies the flags in makeflags, which is in the format of GNU
+// make's MAKEFLAGS environment variable (such as "ks -j4"), to c. The makex
+// command applies $MAKEFLAGS before its command-line flags (which take
+// precedence), so that makex can be run by make as a sub-make.
+//
+// The supported flags are:
+//
+//	-j N, --jobs=N   sets ParallelJobs to N ("-j" without N is ignored)
+//	-n, --dry-run    sets DryRun ("--just-print" and "--recon" also work)
+//	-s, --silent     disables Verbose ("--quiet" also works)
+//	-k, --keep-going sets KeepGoing
+//
+// Single-letter flags may be combined, with or without a leading "-" (as in
+// "ns" or "-ns"). Other flags and variable assignments (such as "CC=gcc")
+// are ignored.
+func (c *Config) ApplyMakeFlags(makeflags string) {
+	words := strings.Fields(makeflags)
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		switch {
+		case w == "--":
+			// The rest are variable assignments.
+			return
+		case strings.HasPrefix(w, "--"):
+			name, value := w[2:], ""
+			if j := strings.IndexByte(name, '='); j != -1 {
+				name, value = name[:j], name[j+1:]
+			}
+			switch name {
+			case "jobs":
+				c.setMakeFlagJobs(value)
+			case "dry-run", "just-print", "recon":
+				c.DryRun = true
+			case "silent", "quiet":
+				c.Verbose = false
+			case "keep-going":
+				c.KeepGoing = true
+			}
+		case strings.ContainsRune(w, '='):
+			// A variable assignment.
+		case strings.HasPrefix(w, "-") || i == 0:
+			// A group of single-letter flags, which doesn't start
+			// with "-" if it's the first word.
+			letters := strings.TrimPrefix(w, "-")
+			for j := 0; j < len(letters); j++ {
+				switch letters[j] {
+				case 'j':
+					n := letters[j+1:]
+					if n == "" && i+1 < len(words) {
+						if _, err := strconv.Atoi(words[i+1]); err == nil {
+							n = words[i+1]
+							i++
+						}
+					}
+					c.setMakeFlagJobs(n)
+					j = len(letters)
+				case 'k':
+					c.KeepGoing = true
+				case 'n':
+					c.DryRun = true
+				case 's':
+					c.Verbose = false
+				}
+			}
+		}
+	}
+}
+
+func (c *Config) setMakeFlagJobs(n string) {
+	if jobs, err := strconv.Atoi(n); err == nil && jobs > 0 {
+		c.ParallelJobs = jobs
+	}
+}
+
+// MakeFlags returns the value of the MAKEFLAGS environment variable that
+// recipes are run with, so that sub-makes (whether makex or GNU make) inherit
+// c's settings. It includes "k" if KeepGoing is set, "n" if DryRun is set, "s"
+// unless Verbose is set (because makex only echoes recipes in verbose mode),
+// and "-jN" if ParallelJobs is more than 1.
+func (c *Config) MakeFlags() string {
+	var letters string
+	if c.KeepGoing {
+		letters += "k"
+	}
+	if c.DryRun {
+		letters += "n"
+	}
+	if !c.Verbose {
+		letters += "s"
+	}
+	var flags []string
+	if letters != "" {
+		flags = append(flags, letters)
+	}
+	if c.ParallelJobs > 1 {
+		flags = append(flags, "-j"+strconv.Itoa(c.ParallelJobs))
+	}
+	return strings.Join(flags, " ")
+}
+
+// recipeEnv returns the environment that recipe commands are run with: m.Env
+// if it is non-nil, or else the current process's environment (only the
+// variables in m.EnvAllowlist, if set), with MAKEFLAGS set to m.MakeFlags().
+func (m *Maker) recipeEnv() []string {
+	var allowed map[string]bool
+	if m.EnvAllowlist != nil && m.Env == nil {
+		allowed = make(map[string]bool, len(m.EnvAllowlist))
+		for _, name := range m.EnvAllowlist {
+			allowed[name] = true
+		}
+	}
+
+	env := os.Environ()
+	if m.Env != nil {
+		env = m.Env
+	}
+	vars := make([]string, 0, len(env)+1)
+	for _, v := range env {
+		name := v
+		if i := strings.IndexByte(v, '='); i != -1 {
+			name = v[:i]
+		}
+		if name == "MAKEFLAGS" || (allowed != nil && !allowed[name]) {
+			continue
+		}
+		vars = append(vars, v)
+	}
+	return append(vars, "MAKEFLAGS="+m.MakeFlags())
+}
+
+// lookupEnv returns a function that looks up a variable in env (of the form
+// returned by os.Environ), like os.LookupEnv. If a variable is set more than
+// once, the last value is used, as in exec.Cmd.Env.
+func lookupEnv(env []string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		for i := len(env) - 1; i >= 0; i-- {
+			if strings.HasPrefix(env[i], name+"=") {
+				return env[i][len(name)+1:], true
+			}
+		}
+		return "", false
+	}
+}
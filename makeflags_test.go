@@ -0,0 +1,209 @@
+package makex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestConfig_ApplyMakeFlags(t *testing.T) {
+	tests := map[string]Config{
+		"":                                   {ParallelJobs: 1, Verbose: true},
+		"ks -j4 --jobserver-auth=3,4":        {ParallelJobs: 4, KeepGoing: true},
+		"n":                                  {ParallelJobs: 1, Verbose: true, DryRun: true},
+		"-n -j 3":                            {ParallelJobs: 3, Verbose: true, DryRun: true},
+		"-nj2":                               {ParallelJobs: 2, Verbose: true, DryRun: true},
+		"--jobs=5 --just-print --quiet":      {ParallelJobs: 5, DryRun: true},
+		"--keep-going":                       {ParallelJobs: 1, Verbose: true, KeepGoing: true},
+		"-j":                                 {ParallelJobs: 1, Verbose: true},
+		"CC=gcc -- n":                        {ParallelJobs: 1, Verbose: true},
+		" -w --no-print-directory -- FOO=ns": {ParallelJobs: 1, Verbose: true},
+	}
+	for makeflags, want := range tests {
+		conf := Config{ParallelJobs: 1, Verbose: true}
+		conf.ApplyMakeFlags(makeflags)
+		if !reflect.DeepEqual(conf, want) {
+			t.Errorf("%q: got config %+v, want %+v", makeflags, conf, want)
+		}
+	}
+}
+
+func TestConfig_MakeFlags(t *testing.T) {
+	tests := []struct {
+		conf Config
+		want string
+	}{
+		{Config{ParallelJobs: 1, Verbose: true}, ""},
+		{Config{ParallelJobs: 1}, "s"},
+		{Config{ParallelJobs: 4, DryRun: true}, "ns -j4"},
+		{Config{ParallelJobs: 2, Verbose: true}, "-j2"},
+		{Config{ParallelJobs: 1, KeepGoing: true, DryRun: true}, "kns"},
+	}
+	for _, test := range tests {
+		if got := test.conf.MakeFlags(); got != test.want {
+			t.Errorf("%+v: got MakeFlags %q, want %q", test.conf, got, test.want)
+			continue
+		}
+
+		// The flags should round-trip.
+		conf := Config{ParallelJobs: 1, Verbose: true}
+		conf.ApplyMakeFlags(test.want)
+		if !reflect.DeepEqual(conf, test.conf) {
+			t.Errorf("%q: got config %+v after applying flags, want %+v", test.want, conf, test.conf)
+		}
+	}
+}
+
+func TestMaker_Run_makeflags(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer os.Setenv("MAKEFLAGS", os.Getenv("MAKEFLAGS"))
+	os.Setenv("MAKEFLAGS", "k")
+
+	conf := &Config{ParallelJobs: 3, FS: NewOSFileSystem(tmpDir)}
+	out := filepath.ToSlash(filepath.Join(tmpDir, "x"))
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{`printf "%s" "$MAKEFLAGS" > ` + out}},
+	}}
+	if err := conf.NewMaker(mf, "x").Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(data)), "s -j3"; got != want {
+		t.Errorf("got recipe MAKEFLAGS %q, want %q", got, want)
+	}
+}
+
+func TestMaker_recipeEnv_envAllowlist(t *testing.T) {
+	defer os.Setenv("MAKEX_TEST_ALLOWED", os.Getenv("MAKEX_TEST_ALLOWED"))
+	defer os.Setenv("MAKEX_TEST_DENIED", os.Getenv("MAKEX_TEST_DENIED"))
+	os.Setenv("MAKEX_TEST_ALLOWED", "a")
+	os.Setenv("MAKEX_TEST_DENIED", "d")
+
+	tests := map[string]struct {
+		allowlist []string
+		want      []string
+	}{
+		"nil allowlist":   {want: []string{"MAKEFLAGS=s", "MAKEX_TEST_ALLOWED=a", "MAKEX_TEST_DENIED=d"}},
+		"allowlist":       {allowlist: []string{"MAKEX_TEST_ALLOWED", "MAKEX_TEST_UNSET"}, want: []string{"MAKEFLAGS=s", "MAKEX_TEST_ALLOWED=a"}},
+		"empty allowlist": {allowlist: []string{}, want: []string{"MAKEFLAGS=s"}},
+	}
+	for label, test := range tests {
+		conf := &Config{ParallelJobs: 1, EnvAllowlist: test.allowlist}
+		var got []string
+		for _, v := range conf.NewMaker(&Makefile{}).recipeEnv() {
+			if strings.HasPrefix(v, "MAKEX_TEST_") || strings.HasPrefix(v, "MAKEFLAGS=") {
+				got = append(got, v)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got env %q, want %q", label, got, test.want)
+		}
+	}
+}
+
+func TestMaker_recipeEnv_env(t *testing.T) {
+	defer setenv("MAKEX_TEST_INHERITED", "i")()
+
+	tests := map[string]struct {
+		env  []string
+		want []string
+	}{
+		"nil env":   {want: []string{"MAKEFLAGS=s", "MAKEX_TEST_INHERITED=i"}},
+		"env":       {env: []string{"MAKEX_TEST_SET=s", "MAKEFLAGS=k"}, want: []string{"MAKEFLAGS=s", "MAKEX_TEST_SET=s"}},
+		"empty env": {env: []string{}, want: []string{"MAKEFLAGS=s"}},
+	}
+	for label, test := range tests {
+		conf := &Config{ParallelJobs: 1, Env: test.env, EnvAllowlist: []string{"MAKEX_TEST_INHERITED"}}
+		var got []string
+		for _, v := range conf.NewMaker(&Makefile{}).recipeEnv() {
+			if strings.HasPrefix(v, "MAKEX_TEST_") || strings.HasPrefix(v, "MAKEFLAGS=") {
+				got = append(got, v)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got env %q, want %q", label, got, test.want)
+		}
+	}
+}
+
+func TestMaker_Run_env(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer setenv("MAKEX_TEST_INHERITED", "i")()
+
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewOSFileSystem(tmpDir),
+		Env:          []string{"MAKEX_TEST_SET=a", "MAKEX_TEST_SET=b", "CC=envcc"},
+	}
+	out := filepath.ToSlash(filepath.Join(tmpDir, "x"))
+	mf, err := Parse([]byte(`
+CC = cc
+x:
+	printf "%s,%s,%s,%s" "$$MAKEX_TEST_SET" "$(MAKEX_TEST_SET)" "$(CC)" "$$MAKEX_TEST_INHERITED$(MAKEX_TEST_INHERITED)" > ` + out + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.NewMaker(mf, "x").Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "b,b,cc,"; got != want {
+		t.Errorf("got recipe output %q, want %q", got, want)
+	}
+}
+
+func TestMaker_expandRecipe_envAllowlist(t *testing.T) {
+	defer os.Setenv("MAKEX_TEST_ALLOWED", os.Getenv("MAKEX_TEST_ALLOWED"))
+	defer os.Setenv("MAKEX_TEST_DENIED", os.Getenv("MAKEX_TEST_DENIED"))
+	os.Setenv("MAKEX_TEST_ALLOWED", "a")
+	os.Setenv("MAKEX_TEST_DENIED", "d")
+
+	conf := &Config{ParallelJobs: 1, EnvAllowlist: []string{"MAKEX_TEST_ALLOWED"}}
+	rule := &BasicRule{TargetFile: "x"}
+	mf := &Makefile{Vars: map[string]*Var{}}
+	got, err := conf.NewMaker(mf).expandRecipe(rule, "echo $(MAKEX_TEST_ALLOWED),$(MAKEX_TEST_DENIED)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo a,"; got != want {
+		t.Errorf("got expanded recipe %q, want %q", got, want)
+	}
+}
+
+// setenv sets the environment variable name to value and returns a function
+// that restores it (unsetting it if it wasn't set), so that tests that check
+// which variables are inherited aren't affected by earlier tests.
+func setenv(name, value string) (restore func()) {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
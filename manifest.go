@@ -0,0 +1,147 @@
+package makex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+)
+
+// ManifestVersion is the version of the manifest schema (see Manifest). It is
+// incremented when the schema changes incompatibly.
+const ManifestVersion = 1
+
+// A Manifest records the inputs and outputs of each target built by a call to
+// Maker.Run, with their contents' hashes, so that downstream tools can attest
+// what went into each artifact. It is written as JSON to Config.ManifestPath.
+type Manifest struct {
+	Version int `json:"version"`
+
+	// Fingerprint is the hex-encoded SHA-256 hash of the JSON encoding of
+	// Targets, which identifies the build's inputs, recipes, and outputs.
+	Fingerprint string `json:"fingerprint"`
+
+	// Targets are the targets that were built successfully (except phony
+	// targets and services), ordered by target name.
+	Targets []ManifestTarget `json:"targets"`
+}
+
+// A ManifestTarget is a target in a Manifest.
+type ManifestTarget struct {
+	Target string `json:"target"`
+
+	// Recipes are the expanded recipe commands that were run.
+	Recipes []string `json:"recipes"`
+
+	// Inputs are the target's prereqs and stale inputs that are files,
+	// and Outputs are its outputs (see OutputsRule), hashed when the target
+	// was built.
+	Inputs  []ManifestFile `json:"inputs"`
+	Outputs []ManifestFile `json:"outputs"`
+}
+
+// A ManifestFile is a file in a Manifest.
+type ManifestFile struct {
+	Path string `json:"path"`
+
+	// SHA256 is the hex-encoded SHA-256 hash of the file's contents.
+	SHA256 string `json:"sha256"`
+}
+
+// recordManifest adds rule, whose recipes were just run successfully, to the
+// manifest.
+func (m *Maker) recordManifest(rule Rule, recipes []string) error {
+	if isPhony(m, rule.Target()) || isService(rule) {
+		return nil
+	}
+	if recipes == nil {
+		recipes = []string{}
+	}
+	t := ManifestTarget{Target: rule.Target(), Recipes: recipes, Inputs: []ManifestFile{}, Outputs: []ManifestFile{}}
+	var inputs []string
+	for _, p := range append(append([]string{}, rule.Prereqs()...), staleInputs(rule)...) {
+		if !isPhony(m, p) && !isService(m.rule(p)) {
+			inputs = append(inputs, p)
+		}
+	}
+	for _, input := range uniqAndSort(inputs) {
+		sum, err := m.fileHash(input)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		t.Inputs = append(t.Inputs, ManifestFile{Path: input, SHA256: sum})
+	}
+	for _, output := range ruleOutputs(rule) {
+		sum, err := m.fileHash(output)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		t.Outputs = append(t.Outputs, ManifestFile{Path: output, SHA256: sum})
+	}
+
+	m.manifestMu.Lock()
+	defer m.manifestMu.Unlock()
+	m.manifest = append(m.manifest, t)
+	return nil
+}
+
+// fileHash returns the hex-encoded SHA-256 hash of the contents of the file at
+// path in m's filesystem.
+func (m *Maker) fileHash(path string) (string, error) {
+	f, err := m.fs().Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Manifest returns the manifest of the targets built during the most recent
+// call to Run.
+func (m *Maker) Manifest() *Manifest {
+	m.manifestMu.Lock()
+	targets := make([]ManifestTarget, len(m.manifest))
+	copy(targets, m.manifest)
+	m.manifestMu.Unlock()
+
+	sort.Sort(manifestTargetsByName(targets))
+	data, _ := json.Marshal(targets)
+	sum := sha256.Sum256(data)
+	return &Manifest{Version: ManifestVersion, Fingerprint: hex.EncodeToString(sum[:]), Targets: targets}
+}
+
+// writeManifest writes m's Manifest to m.ManifestPath (on the local
+// filesystem, not FS).
+func (m *Maker) writeManifest() error {
+	data, err := json.MarshalIndent(m.Manifest(), "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(m.ManifestPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type manifestTargetsByName []ManifestTarget
+
+func (v manifestTargetsByName) Len() int           { return len(v) }
+func (v manifestTargetsByName) Less(i, j int) bool { return v[i].Target < v[j].Target }
+func (v manifestTargetsByName) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
@@ -0,0 +1,84 @@
+package makex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_manifest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fs := NewFileSystem(rwvfs.Map(map[string]string{"x.c": "int x;", "x.h": "extern int x;"}))
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           fs,
+		ManifestPath: filepath.Join(tmpDir, "manifest.json"),
+		Builtins: map[string]func(Rule, []string) error{
+			"write": func(_ Rule, args []string) error {
+				w, err := fs.Create(args[0])
+				if err != nil {
+					return err
+				}
+				defer w.Close()
+				_, err = io.WriteString(w, args[1])
+				return err
+			},
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"all"}},
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"x.o"}},
+		&BasicRule{TargetFile: "x.o", PrereqFiles: []string{"x.c", "x.h"}, RecipeCmds: []string{"@makex:call write $@ obj"}},
+	}}
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(conf.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	wantTargets := []ManifestTarget{{
+		Target:  "x.o",
+		Recipes: []string{"@makex:call write x.o obj"},
+		Inputs:  []ManifestFile{{"x.c", hash("int x;")}, {"x.h", hash("extern int x;")}},
+		Outputs: []ManifestFile{{"x.o", hash("obj")}},
+	}}
+	if !reflect.DeepEqual(manifest.Targets, wantTargets) {
+		t.Errorf("got manifest targets %+v, want %+v", manifest.Targets, wantTargets)
+	}
+	if manifest.Version != ManifestVersion {
+		t.Errorf("got manifest version %d, want %d", manifest.Version, ManifestVersion)
+	}
+	targetsJSON, _ := json.Marshal(wantTargets)
+	if want := hash(string(targetsJSON)); manifest.Fingerprint != want {
+		t.Errorf("got fingerprint %q, want %q", manifest.Fingerprint, want)
+	}
+}
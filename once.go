@@ -0,0 +1,63 @@
+package makex
+
+import "log"
+
+// A RunOnceRule is a Rule whose recipes must run at most once per call to
+// Maker.Run, such as a setup step that isn't idempotent (e.g., starting an
+// emulator) but that many targets depend on. Normally a target is built at
+// most once per build anyway, but Run may build it again when it retries a
+// build (see Config.BuildRetries), and its recipes may be skipped in favor of
+// another target's (see Config.CoalesceIdenticalRecipes). A run-once target's
+// recipes are never coalesced, and when it is built again during the same
+// Run, its recipes aren't run again: the target gets the result (success or
+// error) of their first run.
+type RunOnceRule interface {
+	Rule
+
+	RunOnce() bool
+}
+
+// isRunOnce reports whether rule is a RunOnceRule whose RunOnce method returns
+// true.
+func isRunOnce(rule Rule) bool {
+	r, ok := rule.(RunOnceRule)
+	return ok && r.RunOnce()
+}
+
+// An onceGate records the first build of a run-once target during a call to
+// Run.
+type onceGate struct {
+	done chan struct{} // closed when the first build finishes
+	err  error         // the first build's error, if any (set before done is closed)
+}
+
+// buildOnce calls build, unless rule is run-once and has already started
+// building during the current call to Run, in which case it waits for that
+// build to finish and returns its error.
+func (m *Maker) buildOnce(rule Rule, log *log.Logger, build func() error) error {
+	if !isRunOnce(rule) {
+		return build()
+	}
+
+	m.onceGatesMu.Lock()
+	g, started := m.onceGates[rule.Target()]
+	if !started {
+		if m.onceGates == nil {
+			m.onceGates = make(map[string]*onceGate)
+		}
+		g = &onceGate{done: make(chan struct{})}
+		m.onceGates[rule.Target()] = g
+	}
+	m.onceGatesMu.Unlock()
+
+	if started {
+		<-g.done
+		if m.Verbose {
+			log.Print("run-once recipes already ran during this build; not running them again")
+		}
+		return g.err
+	}
+	defer close(g.done)
+	g.err = build()
+	return g.err
+}
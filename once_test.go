@@ -0,0 +1,69 @@
+package makex
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_runOnce(t *testing.T) {
+	for _, once := range []bool{false, true} {
+		var setups, flakes int
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+			BuildRetries: 2,
+			TransientError: func(err error) bool {
+				return strings.Contains(err.Error(), "connection reset")
+			},
+			Builtins: map[string]func(Rule, []string) error{
+				"setup": func(Rule, []string) error {
+					setups++
+					return nil
+				},
+				"flaky": func(Rule, []string) error {
+					flakes++
+					if flakes == 1 {
+						return errors.New("connection reset")
+					}
+					return nil
+				},
+			},
+			Log: log.New(ioutil.Discard, "", 0),
+		}
+		// setup is phony, so it is built again when the build is
+		// retried because x failed.
+		mf := &Makefile{Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"setup", "x"}},
+			&BasicRule{TargetFile: "setup", RecipeCmds: []string{"@makex:call setup"}, Once: once},
+			&BasicRule{TargetFile: "x", PrereqFiles: []string{"setup"}, RecipeCmds: []string{"@makex:call flaky"}},
+		}}
+		mk := conf.NewMaker(mf, "x")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		if err := mk.Run(); err != nil {
+			t.Fatalf("once=%v: %s", once, err)
+		}
+		want := 2
+		if once {
+			want = 1
+		}
+		if setups != want {
+			t.Errorf("once=%v: got %d runs of setup's recipes, want %d", once, setups, want)
+		}
+
+		// Each Run may run setup's recipes again.
+		if err := mk.Run(); err != nil {
+			t.Fatalf("once=%v: second Run: %s", once, err)
+		}
+		if setups != want+1 {
+			t.Errorf("once=%v: got %d runs of setup's recipes after second Run, want %d", once, setups, want+1)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package makex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// A lineWriter writes to w and also passes each complete line written to it to
+// Config.OnOutputLine and Config.OnDiagnostic.
+type lineWriter struct {
+	w      io.WriteCloser
+	m      *Maker
+	rule   Rule
+	stream string
+
+	mu  sync.Mutex
+	buf []byte // the incomplete last line
+}
+
+func (m *Maker) newLineWriter(rule Rule, stream string, w io.WriteCloser) *lineWriter {
+	return &lineWriter{w: w, m: m, rule: rule, stream: stream}
+}
+
+// withLineWriters wraps rule's stdout and stderr writers in lineWriters. If
+// they are the same writer (as with Config.PerTargetLogOnly), they are wrapped
+// in the same lineWriter, whose stream is "combined", so that recipes still
+// write both to the same pipe (see exec.Cmd), which keeps them in order.
+func (m *Maker) withLineWriters(rule Rule, stdout, stderr io.WriteCloser) (io.WriteCloser, io.WriteCloser) {
+	if sameWriter(stdout, stderr) {
+		lw := m.newLineWriter(rule, "combined", stdout)
+		return lw, lw
+	}
+	return m.newLineWriter(rule, "stdout", stdout), m.newLineWriter(rule, "stderr", stderr)
+}
+
+// sameWriter reports whether a and b are the same writer. Like exec.Cmd, it
+// reports false if they can't be compared.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() { recover() }()
+	return a == b
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i == -1 {
+			break
+		}
+		lw.emit(lw.buf[:i])
+		lw.buf = lw.buf[i+1:]
+	}
+	return lw.w.Write(p)
+}
+
+// flush passes the incomplete last line, if any, to OnOutputLine and
+// OnDiagnostic.
+func (lw *lineWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.buf) > 0 {
+		lw.emit(lw.buf)
+		lw.buf = nil
+	}
+}
+
+func (lw *lineWriter) emit(line []byte) {
+	lw.m.outputLineMu.Lock()
+	defer lw.m.outputLineMu.Unlock()
+	if lw.m.OnOutputLine != nil {
+		lw.m.OnOutputLine(lw.rule, lw.stream, string(line))
+	}
+	if lw.m.OnDiagnostic != nil {
+		if d, ok := lw.m.diagnostic(lw.rule, string(line)); ok {
+			lw.m.OnDiagnostic(d)
+		}
+	}
+}
+
+func (lw *lineWriter) Close() error {
+	lw.flush()
+	return lw.w.Close()
+}
+
+// flushLines flushes the incomplete last lines of the writers that are
+// lineWriters.
+func flushLines(ws ...io.Writer) {
+	for _, w := range ws {
+		if lw, ok := w.(*lineWriter); ok {
+			lw.flush()
+		}
+	}
+}
+
+// TargetLogFile returns the name of the file in Config.PerTargetLogDir that
+// receives target's output. It is the target name with each byte other
+// than an ASCII letter, digit, ".", "-", or "_" replaced by "%XX" (its
+// hexadecimal value), followed by ".log". So, for example, the log file for
+// target "out/x.o" is "out%2Fx.o.log".
+func TargetLogFile(target string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(target); i++ {
+		switch c := target[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-', c == '_':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	b.WriteString(".log")
+	return b.String()
+}
+
+// withTargetLog creates rule's log file in m.PerTargetLogDir and returns
+// writers and a logger that write to it (and also to stdout, stderr, and
+// logger, respectively, unless m.PerTargetLogOnly is set). If the log file
+// can't be created, a warning is logged and the original writers are returned.
+func (m *Maker) withTargetLog(rule Rule, stdout, stderr io.WriteCloser, logger *log.Logger) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+	if err := os.MkdirAll(m.PerTargetLogDir, 0755); err != nil {
+		logger.Printf("warning: creating log directory failed: %s", err)
+		return stdout, stderr, logger
+	}
+	f, err := os.Create(filepath.Join(m.PerTargetLogDir, TargetLogFile(rule.Target())))
+	if err != nil {
+		logger.Printf("warning: creating log file failed: %s", err)
+		return stdout, stderr, logger
+	}
+
+	tl := &targetLog{f: f, refs: 2}
+	if m.PerTargetLogOnly {
+		// Use the same writer for stdout and stderr so that recipes
+		// write both to the same pipe, which keeps them in order in
+		// the log file. The original writers aren't written to, but
+		// they are still closed.
+		tl.closers = []io.Closer{stdout, stderr}
+		w := &targetLogWriter{log: tl}
+		return w, w, log.New(f, logger.Prefix(), logger.Flags())
+	}
+	logw := io.MultiWriter(logger.Writer(), f)
+	return &targetLogWriter{stdout, tl}, &targetLogWriter{stderr, tl}, log.New(logw, logger.Prefix(), logger.Flags())
+}
+
+// A targetLog is a target's log file (see Config.PerTargetLogDir), which is
+// closed when both of the target's targetLogWriters are closed.
+type targetLog struct {
+	f    *os.File
+	refs int32
+
+	// closers are closed along with f.
+	closers []io.Closer
+}
+
+// A targetLogWriter writes to a target's log file and to w (if non-nil).
+type targetLogWriter struct {
+	w   io.WriteCloser
+	log *targetLog
+}
+
+func (tw *targetLogWriter) Write(p []byte) (int, error) {
+	if tw.w != nil {
+		if n, err := tw.w.Write(p); err != nil {
+			return n, err
+		}
+	}
+	return tw.log.f.Write(p)
+}
+
+func (tw *targetLogWriter) Close() error {
+	var err error
+	if tw.w != nil {
+		err = tw.w.Close()
+	}
+	if atomic.AddInt32(&tw.log.refs, -1) == 0 {
+		for _, c := range tw.log.closers {
+			if err2 := c.Close(); err == nil {
+				err = err2
+			}
+		}
+		if err2 := tw.log.f.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// withOutputOptions applies m.PrefixOutput and m.GroupOutput to rule's output
+// writers and logger.
+func (m *Maker) withOutputOptions(rule Rule, stdout, stderr io.WriteCloser, logger *log.Logger) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+	if m.GroupOutput && !isService(rule) {
+		g := &outputGroup{m: m, open: 2}
+		stdout, stderr = &groupWriter{g, stdout}, &groupWriter{g, stderr}
+		logger = log.New(&groupWriter{g, nopCloser{logger.Writer()}}, logger.Prefix(), logger.Flags())
+	}
+	if m.PrefixOutput {
+		prefix := "[" + rule.Target() + "] "
+		stdout, stderr = &prefixWriter{w: stdout, prefix: prefix}, &prefixWriter{w: stderr, prefix: prefix}
+	}
+	return stdout, stderr, logger
+}
+
+// A prefixWriter writes each line written to it to w, prefixed with prefix
+// (see Config.PrefixOutput).
+type prefixWriter struct {
+	w      io.WriteCloser
+	prefix string
+
+	mu  sync.Mutex
+	buf []byte // the incomplete last line
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i == -1 {
+			break
+		}
+		line := append([]byte(pw.prefix), pw.buf[:i+1]...)
+		pw.buf = pw.buf[i+1:]
+		if _, err := pw.w.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes the incomplete last line, if any (with a newline), and closes
+// w.
+func (pw *prefixWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	var err error
+	if len(pw.buf) > 0 {
+		_, err = pw.w.Write(append(append([]byte(pw.prefix), pw.buf...), '\n'))
+		pw.buf = nil
+	}
+	if err2 := pw.w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// An outputGroup buffers the output of a target's recipes and the messages
+// logged about it (see Config.GroupOutput) until both its stdout and stderr
+// groupWriters are closed. It then writes the buffered output to the
+// underlying writers, in the order that it was written, while holding
+// m.groupOutputMu, so that it isn't interleaved with other targets' output.
+type outputGroup struct {
+	m *Maker
+
+	mu      sync.Mutex
+	chunks  []outputChunk
+	open    int         // the number of groupWriters not yet closed
+	closers []io.Closer // the underlying writers of the closed groupWriters
+	flushed bool
+}
+
+// An outputChunk is data written to a groupWriter whose underlying writer is
+// w.
+type outputChunk struct {
+	w    io.Writer
+	data []byte
+}
+
+func (g *outputGroup) write(w io.Writer, p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flushed {
+		return w.Write(p)
+	}
+	g.chunks = append(g.chunks, outputChunk{w, append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+// close records that one of g's groupWriters, whose underlying writer is c,
+// was closed. When all of them are closed, it writes the buffered output and
+// closes the underlying writers.
+func (g *outputGroup) close(c io.Closer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closers = append(g.closers, c)
+	if g.open--; g.open > 0 || g.flushed {
+		return nil
+	}
+	g.flushed = true
+
+	var err error
+	g.m.groupOutputMu.Lock()
+	for _, c := range g.chunks {
+		if _, err2 := c.w.Write(c.data); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	g.m.groupOutputMu.Unlock()
+	g.chunks = nil
+	for _, c := range g.closers {
+		if err2 := c.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// A groupWriter writes to w via an outputGroup.
+type groupWriter struct {
+	g *outputGroup
+	w io.WriteCloser
+}
+
+func (gw *groupWriter) Write(p []byte) (int, error) { return gw.g.write(gw.w, p) }
+
+func (gw *groupWriter) Close() error { return gw.g.close(gw.w) }
@@ -0,0 +1,322 @@
+package makex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_onOutputLine(t *testing.T) {
+	var lines []string
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		OnOutputLine: func(r Rule, stream, line string) {
+			lines = append(lines, r.Target()+" "+stream+": "+line)
+		},
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"a", "b"}},
+			&BasicRule{TargetFile: "a", RecipeCmds: []string{"echo a1; echo a2", "printf a3"}},
+			&BasicRule{TargetFile: "b", RecipeCmds: []string{"echo b1 >&2; printf b2 >&2"}},
+		},
+	}
+	mk := conf.NewMaker(mf, "a", "b")
+	// The writers must differ; otherwise the streams are combined.
+	var stdout, stderr lockedBuffer
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{&stdout}, nopCloser{&stderr}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(lines)
+	want := []string{
+		"a stdout: a1",
+		"a stdout: a2",
+		"a stdout: a3",
+		"b stderr: b1",
+		"b stderr: b2",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got lines %q, want %q", lines, want)
+	}
+}
+
+func TestMaker_withLineWriters(t *testing.T) {
+	mk := (&Config{OnOutputLine: func(Rule, string, string) {}}).NewMaker(&Makefile{})
+	rule := &BasicRule{TargetFile: "a"}
+	var stdout, stderr bytes.Buffer
+	w := nopCloser{&stdout}
+	if o, e := mk.withLineWriters(rule, w, w); o != e || o.(*lineWriter).stream != "combined" {
+		t.Errorf("got stdout %+v and stderr %+v for the same writer, want one combined lineWriter", o, e)
+	}
+	o, e := mk.withLineWriters(rule, w, nopCloser{&stderr})
+	if o == e || o.(*lineWriter).stream != "stdout" || e.(*lineWriter).stream != "stderr" {
+		t.Errorf("got stdout %+v and stderr %+v for different writers, want separate lineWriters", o, e)
+	}
+}
+
+func TestTargetLogFile(t *testing.T) {
+	tests := map[string]string{
+		"x":        "x.log",
+		"out/x.o":  "out%2Fx.o.log",
+		"../a b":   "..%2Fa%20b.log",
+		`c:\x_y-z`: "c%3A%5Cx_y-z.log",
+	}
+	for target, want := range tests {
+		if got := TargetLogFile(target); got != want {
+			t.Errorf("%q: got %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestMaker_Run_perTargetLogDir(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "makex-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"out/a"}},
+			&BasicRule{TargetFile: "out/a", RecipeCmds: []string{"echo out; echo err >&2"}},
+		},
+	}
+	for _, only := range []bool{false, true} {
+		var stdout bytes.Buffer
+		conf := &Config{
+			ParallelJobs:     1,
+			FS:               NewFileSystem(rwvfs.Map(map[string]string{})),
+			PerTargetLogDir:  logDir,
+			PerTargetLogOnly: only,
+		}
+		mk := conf.NewMaker(mf, "out/a")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{&stdout}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		if err := mk.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(logDir, "out%2Fa.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(data)
+		if !only && got == "err\nout\n" {
+			// stdout and stderr are written concurrently.
+			got = "out\nerr\n"
+		}
+		if want := "out\nerr\n"; got != want {
+			t.Errorf("only=%v: got log file %q, want %q", only, got, want)
+		}
+		wantStdout := "out\n"
+		if only {
+			wantStdout = ""
+		}
+		if got := stdout.String(); got != wantStdout {
+			t.Errorf("only=%v: got stdout %q, want %q", only, got, wantStdout)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMaker_Run_prefixAndGroupOutput(t *testing.T) {
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"a", "b"}},
+			&BasicRule{TargetFile: "a", RecipeCmds: []string{"echo a1; sleep 0.2; echo a2 >&2"}},
+			&BasicRule{TargetFile: "b", RecipeCmds: []string{"sleep 0.1; echo b1; sleep 0.2; printf b2; false"}},
+		},
+	}
+	tests := map[string]struct {
+		prefix, group bool
+		want          string
+	}{
+		"prefix": {
+			prefix: true,
+			want:   "[a] a1\n[b] b1\n[a] a2\nb: recipe 1 of 1 for target b failed: sleep 0.1; echo b1; sleep 0.2; printf b2; false (exit status 1)\n[b] b2\n",
+		},
+		"group": {
+			group: true,
+			want:  "a1\na2\nb1\nb2b: recipe 1 of 1 for target b failed: sleep 0.1; echo b1; sleep 0.2; printf b2; false (exit status 1)\n",
+		},
+		"prefix and group": {
+			prefix: true,
+			group:  true,
+			want:   "[a] a1\n[a] a2\n[b] b1\nb: recipe 1 of 1 for target b failed: sleep 0.1; echo b1; sleep 0.2; printf b2; false (exit status 1)\n[b] b2\n",
+		},
+	}
+	for label, test := range tests {
+		var out lockedBuffer
+		conf := &Config{
+			ParallelJobs: 2,
+			FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+			PrefixOutput: test.prefix,
+			GroupOutput:  test.group,
+		}
+		mk := conf.NewMaker(mf, "a", "b")
+		mk.RuleOutput = func(r Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{&out}, nopCloser{&out}, log.New(&out, r.Target()+": ", 0)
+		}
+		if err := mk.Run(); err == nil {
+			t.Errorf("%s: got no error from failed recipe", label)
+		}
+		if got := out.String(); got != test.want {
+			t.Errorf("%s: got output\n%s\nwant\n%s", label, got, test.want)
+		}
+	}
+}
+
+// closeCounter counts the calls to its Close method.
+type closeCounter struct {
+	io.Writer
+
+	mu     sync.Mutex
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closes++
+	return nil
+}
+
+func TestMaker_Run_perTargetLogOnlyWithGroupOutput(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "makex-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"a"}},
+			&BasicRule{TargetFile: "a", RecipeCmds: []string{"echo out; echo err >&2"}},
+		},
+	}
+	conf := &Config{
+		ParallelJobs:     1,
+		FS:               NewFileSystem(rwvfs.Map(map[string]string{})),
+		PerTargetLogDir:  logDir,
+		PerTargetLogOnly: true,
+		GroupOutput:      true,
+	}
+	var out lockedBuffer
+	stdout, stderr := &closeCounter{Writer: &out}, &closeCounter{Writer: &out}
+	mk := conf.NewMaker(mf, "a")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return stdout, stderr, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout.closes != 1 || stderr.closes != 1 {
+		t.Errorf("got %d and %d calls to the stdout and stderr writers' Close methods, want 1 each", stdout.closes, stderr.closes)
+	}
+	if got := out.String(); got != "" {
+		t.Errorf("got output %q, want none (it only goes to the log file)", got)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(logDir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "out\nerr\n"; got != want {
+		t.Errorf("got log file %q, want %q", got, want)
+	}
+}
+
+func TestMaker_Run_perTargetLogOnlyWithOnOutputLine(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "makex-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+
+	// The recipe alternates between stdout and stderr, which stay in
+	// order because PerTargetLogOnly gives them the same writer.
+	var want []string
+	recipe := "for i in 1 2 3 4 5 6 7 8 9 10; do echo out$i; echo x.c:$i:1: warning: w$i >&2; done"
+	for i := 1; i <= 10; i++ {
+		want = append(want, fmt.Sprintf("out%d", i), fmt.Sprintf("x.c:%d:1: warning: w%d", i, i))
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"a"}},
+			&BasicRule{TargetFile: "a", RecipeCmds: []string{recipe}},
+		},
+	}
+	var lines []string
+	var diagLines []int
+	conf := &Config{
+		ParallelJobs:     1,
+		FS:               NewFileSystem(rwvfs.Map(map[string]string{})),
+		PerTargetLogDir:  logDir,
+		PerTargetLogOnly: true,
+		OnOutputLine: func(r Rule, stream, line string) {
+			lines = append(lines, stream+": "+line)
+		},
+		OnDiagnostic: func(d Diagnostic) {
+			diagLines = append(diagLines, d.Line)
+		},
+	}
+	mk := conf.NewMaker(mf, "a")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(logDir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), strings.Join(want, "\n")+"\n"; got != want {
+		t.Errorf("got log file %q, want %q", got, want)
+	}
+	var wantLines []string
+	for _, line := range want {
+		wantLines = append(wantLines, "combined: "+line)
+	}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("got lines %q, want %q", lines, wantLines)
+	}
+	if want := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !reflect.DeepEqual(diagLines, want) {
+		t.Errorf("got diagnostics on lines %v, want %v", diagLines, want)
+	}
+}
@@ -5,49 +5,236 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 )
 
 // Parse parses a Makefile into a *Makefile struct.
 //
+// Parse makes a single pass over data, so that large generated makefiles parse
+// quickly.
+//
+// Variables may be defined with "=" (recursively expanded), ":=" or "::="
+// (simply expanded), "?=", "+=", and "!=". Variable references and function
+// calls in targets and prereqs are expanded as the rule is parsed, but those
+// in recipes are only expanded when the recipe is run. So, for example, a
+// "$(shell ...)" in a recursively expanded variable runs only if a target
+// whose recipe refers to the variable is built.
+//
+// Lines beginning with "#" are comments. Comments of the form
+// "#makex:key=value" are annotations that apply to the next rule. The
+// supported annotations are:
+//
+//	#makex:outputs=file...       the rule's recipes also produce the listed files
+//	                             (see OutputsRule)
+//	#makex:stale-inputs=file...  the rule's target is rebuilt when the listed
+//	                             files change (see StaleInputsRule)
+//	#makex:service               the rule's target is a service (see ServiceRule)
+//	#makex:tags=tag...           the rule has the listed tags (see TagsRule)
+//	#makex:run-once              the rule's recipes run at most once per build
+//	                             (see RunOnceRule)
+//
+// Lists in annotation values are separated by commas or spaces.
+//
+// Parse doesn't access the filesystem (globs in prereqs are expanded later, by
+// Config.Expand), but it does run the commands in "$(shell ...)" function
+// calls in targets, prereqs, and simply expanded variables. Use ParseOnly to
+// avoid running them.
+//
 // TODO(sqs): super hacky.
 func Parse(data []byte) (*Makefile, error) {
-	var mf Makefile
+	return parse(data, false)
+}
+
+// ParseOnly parses and validates a Makefile without running any commands, so
+// that it's cheap and safe to call on untrusted or incomplete makefiles (such
+// as in an editor). It is like Parse, except that "$(shell ...)" function
+// calls and "!=" assignments expand to the empty string, and it also reports
+// syntax errors in recipes (such as unterminated variable references) that
+// Parse would only report when the recipe is run.
+func ParseOnly(data []byte) (*Makefile, error) {
+	return parse(data, true)
+}
+
+func parse(data []byte, parseOnly bool) (*Makefile, error) {
+	start := time.Now()
+	mf := Makefile{parsed: true}
+
+	shell := defaultShell
+	if parseOnly {
+		shell = noShell
+	}
 
-	lines := bytes.Split(data, []byte{'\n'})
 	var rule *BasicRule
-	for lineno, lineBytes := range lines {
-		line := string(lineBytes)
-		if strings.HasPrefix(line, "\t") {
+	var annotations []annotation
+	for lineno := 0; len(data) > 0; lineno++ {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+
+		if len(line) > 0 && line[0] == '\t' {
 			if rule == nil {
 				return nil, fmt.Errorf("line %d: indented recipe not inside a rule", lineno)
 			}
-			recipe := strings.TrimPrefix(line, "\t")
-			recipe = ExpandAutoVars(rule, recipe)
+			source := string(line[1:])
+			recipe := source
+			if !isPattern(rule.TargetFile) {
+				// A pattern rule's automatic variables are
+				// expanded when its recipes are run, for the
+				// target that it was used to make.
+				recipe = ExpandAutoVars(rule, recipe)
+			}
+			if recipe != source && rule.RecipeSourceCmds == nil {
+				rule.RecipeSourceCmds = append([]string{}, rule.RecipeCmds...)
+			}
+			if rule.RecipeSourceCmds != nil {
+				rule.RecipeSourceCmds = append(rule.RecipeSourceCmds, source)
+			}
+			if parseOnly {
+				x := mf.newExpander()
+				x.shell = shell
+				if _, err := x.expand(recipe); err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineno, err)
+				}
+			}
 			rule.RecipeCmds = append(rule.RecipeCmds, recipe)
-		} else if strings.Contains(line, ":") {
-			sep := strings.Index(line, ":")
-			targets := strings.Fields(line[:sep])
+		} else if bytes.HasPrefix(line, annotationPrefix) {
+			annotations = append(annotations, annotation{lineno, string(line[len(annotationPrefix):])})
+			rule = nil
+		} else if len(line) > 0 && line[0] == '#' {
+			rule = nil
+		} else if name, op, value, ok := parseAssignment(string(line)); ok {
+			if err := mf.assign(name, op, value, shell); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineno, err)
+			}
+			rule = nil
+		} else if sep := indexUnparenthesized(line, ':'); sep != -1 {
+			targetsStr, prereqsStr := string(line[:sep]), string(line[sep+1:])
+			if bytes.IndexByte(line, '$') != -1 {
+				x := mf.newExpander()
+				x.shell = shell
+				x.markReferenced = true
+				var err error
+				if targetsStr, err = x.expand(targetsStr); err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineno, err)
+				}
+				if prereqsStr, err = x.expand(prereqsStr); err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineno, err)
+				}
+			}
+			targets := strings.Fields(targetsStr)
+			if len(targets) == 0 {
+				return nil, fmt.Errorf("line %d: rule has no target", lineno)
+			}
 			if len(targets) > 1 {
 				return nil, errMultipleTargetsUnsupported(lineno)
 			}
 			target := targets[0]
-			prereqs := strings.Fields(line[sep+1:])
+			prereqs := strings.Fields(prereqsStr)
 			prereqs = uniqAndSort(prereqs)
 			rule = &BasicRule{TargetFile: target, PrereqFiles: prereqs}
+			for _, a := range annotations {
+				if err := a.apply(rule); err != nil {
+					return nil, err
+				}
+			}
+			annotations = nil
 			mf.Rules = append(mf.Rules, rule)
 		} else {
 			rule = nil
 		}
 	}
 
+	mf.ParseDuration = time.Since(start)
 	return &mf, nil
 }
 
+// parseAssignment parses a variable assignment line, such as "CC = gcc" or
+// "OBJS := $(SRCS:.c=.o)".
+func parseAssignment(line string) (name, op, value string, ok bool) {
+	eq := indexUnparenthesized([]byte(line), '=')
+	if eq == -1 {
+		return "", "", "", false
+	}
+	op = "="
+	for _, o := range []string{"::=", ":=", "?=", "+=", "!="} {
+		if strings.HasSuffix(line[:eq+1], o) {
+			op = o
+			break
+		}
+	}
+	name = strings.TrimSpace(line[:eq+1-len(op)])
+	if name == "" || strings.ContainsAny(name, " \t:#=") {
+		return "", "", "", false
+	}
+	return name, op, strings.TrimLeft(line[eq+1:], " \t"), true
+}
+
+// indexUnparenthesized returns the index of the first c in line that is not
+// inside a variable reference or function call, or -1 if there is none.
+func indexUnparenthesized(line []byte, c byte) int {
+	depth := 0
+	for i, b := range line {
+		switch {
+		case b == '(' || b == '{':
+			depth++
+		case b == ')' || b == '}':
+			depth--
+		case b == c && depth == 0:
+			return i
+		}
+	}
+	return -1
+}
+
+var annotationPrefix = []byte("#makex:")
+
+// An annotation is a "#makex:key=value" comment that applies to the rule that
+// follows it.
+type annotation struct {
+	lineno int
+	text   string // the text after "#makex:"
+}
+
+func (a annotation) apply(rule *BasicRule) error {
+	key, value := a.text, ""
+	if i := strings.Index(a.text, "="); i != -1 {
+		key, value = a.text[:i], a.text[i+1:]
+	}
+	switch strings.TrimSpace(key) {
+	case "outputs":
+		rule.OutputFiles = appendOutputs(rule.OutputFiles, annotationList(value))
+	case "stale-inputs":
+		rule.StaleInputFiles = append(rule.StaleInputFiles, annotationList(value)...)
+	case "service":
+		rule.Service = true
+	case "tags":
+		rule.TagNames = append(rule.TagNames, annotationList(value)...)
+	case "run-once":
+		rule.Once = true
+	default:
+		return fmt.Errorf("line %d: unknown annotation %q", a.lineno, key)
+	}
+	return nil
+}
+
+// annotationList splits a comma- or space-separated annotation value.
+func annotationList(value string) []string {
+	return strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\t'
+	})
+}
+
 func errMultipleTargetsUnsupported(lineno int) error {
 	return fmt.Errorf("line %d: rule with multiple targets is yet implemented", lineno)
 }
 
 func uniqAndSort(strs []string) []string {
+	if isUniqAndSorted(strs) {
+		return strs
+	}
 	sort.Strings(strs)
 	uniq := make([]string, 0, len(strs))
 	for i, s := range strs {
@@ -57,3 +244,12 @@ func uniqAndSort(strs []string) []string {
 	}
 	return uniq
 }
+
+func isUniqAndSorted(strs []string) bool {
+	for i := 1; i < len(strs); i++ {
+		if strs[i-1] >= strs[i] {
+			return false
+		}
+	}
+	return true
+}
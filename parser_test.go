@@ -1,6 +1,9 @@
 package makex
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -15,7 +18,7 @@ func TestParse(t *testing.T) {
 		"empty ": {data: ``, wantMakefile: &Makefile{}},
 		"rule with 1 target, 1 prereq": {
 			data:         `x:y`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"y"}, nil}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}}}},
 		},
 		"rule with multiple targets": {
 			data:    `x0 x1:y`,
@@ -23,24 +26,24 @@ func TestParse(t *testing.T) {
 		},
 		"rule with multiple prereqs": {
 			data:         `x : y0 y1`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"y0", "y1"}, nil}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y0", "y1"}}}},
 		},
 		"rule with duplicate prereqs": {
 			data:         `x : y0 y1 y0 y1 y1`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"y0", "y1"}, nil}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y0", "y1"}}}},
 		},
 		"multiple rules": {
 			data: `
 x0:y0
 x1:y1`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x0", []string{"y0"}, nil}, &BasicRule{"x1", []string{"y1"}, nil}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x0", PrereqFiles: []string{"y0"}}, &BasicRule{TargetFile: "x1", PrereqFiles: []string{"y1"}}}},
 		},
 		"rule with recipes": {
 			data: `
 x:y
 	c0
 	c1`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"y"}, []string{"c0", "c1"}}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"c0", "c1"}}}},
 		},
 		"multiple rules with recipes": {
 			data: `
@@ -49,22 +52,101 @@ x0:y0
 a = 3
 x1:y1
 	c1`,
-			wantMakefile: &Makefile{Rules: []Rule{
-				&BasicRule{"x0", []string{"y0"}, []string{"c0"}},
-				&BasicRule{"x1", []string{"y1"}, []string{"c1"}},
-			}},
+			wantMakefile: &Makefile{
+				Rules: []Rule{
+					&BasicRule{TargetFile: "x0", PrereqFiles: []string{"y0"}, RecipeCmds: []string{"c0"}},
+					&BasicRule{TargetFile: "x1", PrereqFiles: []string{"y1"}, RecipeCmds: []string{"c1"}},
+				},
+				Vars: map[string]*Var{"a": {Value: "3"}},
+			},
 		},
 		"recipe with $@ (target) var": {
 			data: `
 x:
 	echo $@`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{}, []string{"echo x"}}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{}, RecipeCmds: []string{"echo x"}, RecipeSourceCmds: []string{"echo $@"}}}},
 		},
 		"recipe with $^ (prereqs) var": {
 			data: `
 x: a b
 	echo $^`,
-			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{"x", []string{"a", "b"}, []string{"echo a b"}}}},
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"a", "b"}, RecipeCmds: []string{"echo a b"}, RecipeSourceCmds: []string{"echo $^"}}}},
+		},
+		"variables": {
+			data: `
+A = $(B) a
+B := b
+C := $(A)
+C += c
+D ?= d
+D ?= dd
+OBJS = x.o y.o
+T = x
+$(T): $(B) $(OBJS:.o=.c)
+	cc -o $@ $(A)`,
+			wantMakefile: &Makefile{
+				Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"b", "x.c", "y.c"}, RecipeCmds: []string{"cc -o x $(A)"}, RecipeSourceCmds: []string{"cc -o $@ $(A)"}}},
+				Vars: map[string]*Var{
+					"A":    {Value: "$(B) a", referenced: true},
+					"B":    {Value: "b", Simple: true, referenced: true},
+					"C":    {Value: "b a c", Simple: true},
+					"D":    {Value: "d"},
+					"OBJS": {Value: "x.o y.o", referenced: true},
+					"T":    {Value: "x", referenced: true},
+				},
+			},
+		},
+		"comments": {
+			data: `
+# x0: y0
+x1:y1`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x1", PrereqFiles: []string{"y1"}}}},
+		},
+		"rule with outputs annotation": {
+			data: `
+#makex:outputs=x.go,x_test.go
+x:y
+	gen`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"gen"}, OutputFiles: []string{"x.go", "x_test.go"}}}},
+		},
+		"rule with service annotation": {
+			data: `
+#makex:service
+db:
+	run-db`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "db", PrereqFiles: []string{}, RecipeCmds: []string{"run-db"}, Service: true}}},
+		},
+		"stale inputs annotation": {
+			data: `
+#makex:stale-inputs=config.json, ~/.tool.conf
+x: y
+	build`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"build"}, StaleInputFiles: []string{"config.json", "~/.tool.conf"}}}},
+		},
+		"tags annotation": {
+			data: `
+#makex:tags=fast,unit
+#makex:tags=lint
+x:
+	check`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "x", PrereqFiles: []string{}, RecipeCmds: []string{"check"}, TagNames: []string{"fast", "unit", "lint"}}}},
+		},
+		"run-once annotation": {
+			data: `
+#makex:run-once
+setup:
+	start-emulator`,
+			wantMakefile: &Makefile{Rules: []Rule{&BasicRule{TargetFile: "setup", PrereqFiles: []string{}, RecipeCmds: []string{"start-emulator"}, Once: true}}},
+		},
+		"unknown annotation": {
+			data: `
+#makex:bogus
+x:y`,
+			wantErr: errors.New(`line 1: unknown annotation "bogus"`),
+		},
+		"rule with no target": {
+			data:    `: y`,
+			wantErr: errors.New(`line 0: rule has no target`),
 		},
 	}
 	for label, test := range tests {
@@ -78,12 +160,51 @@ x: a b
 				continue
 			}
 		}
+		if mf != nil {
+			mf.ParseDuration = 0
+		}
+		if test.wantMakefile != nil {
+			test.wantMakefile.parsed = true
+		}
 		if !reflect.DeepEqual(mf, test.wantMakefile) {
 			t.Errorf("%s: bad parsed Makefile\n=========== got Makefile\n%s\n\n=========== want Makefile\n%s", label, marshalStr(t, mf), marshalStr(t, test.wantMakefile))
 		}
 	}
 }
 
+func TestParseOnly(t *testing.T) {
+	data := []byte(`X := $(shell echo hi)
+x:
+	echo $(X)
+`)
+	mf, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mf.Vars["X"].Value; got != "hi" {
+		t.Errorf("Parse: got X %q, want %q", got, "hi")
+	}
+
+	mf, err = ParseOnly(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mf.Vars["X"].Value; got != "" {
+		t.Errorf("ParseOnly: got X %q, want shell command to not run", got)
+	}
+
+	data = []byte(`x:
+	echo $(X
+`)
+	if _, err := Parse(data); err != nil {
+		t.Errorf("Parse: got error %q, want recipe to not be checked", err)
+	}
+	want := `line 1: unterminated variable reference in "echo $(X"`
+	if _, err := ParseOnly(data); err == nil || err.Error() != want {
+		t.Errorf("ParseOnly: got error %v, want %q", err, want)
+	}
+}
+
 func marshalStr(t *testing.T, mf *Makefile) string {
 	data, err := Marshal(mf)
 	if err != nil {
@@ -91,3 +212,21 @@ func marshalStr(t *testing.T, mf *Makefile) string {
 	}
 	return strings.TrimSpace(string(data))
 }
+
+func BenchmarkParse(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&buf, "out/%d.o: src/%d.c src/%d.h include/common.h\n", i, i, i)
+		fmt.Fprintf(&buf, "\tmkdir -p out\n")
+		fmt.Fprintf(&buf, "\tcc -c -o $@ $<\n")
+		fmt.Fprintln(&buf)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package makex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A Plan records the targets that a Maker would build and the exact commands
+// that it would run to build them. A Plan can be saved, loaded (perhaps on
+// another machine), and run with Maker.RunPlan. It is self-contained: running
+// it doesn't require the makefile that it was created from.
+type Plan struct {
+	// TargetSets are the sets of targets to build, in order. The targets
+	// in each set don't depend on each other and may be built in
+	// parallel.
+	TargetSets [][]PlannedTarget `json:"targetSets"`
+}
+
+// A PlannedTarget is a target in a Plan.
+type PlannedTarget struct {
+	Target  string   `json:"target"`
+	Prereqs []string `json:"prereqs,omitempty"`
+
+	// Outputs are the files, other than the target, that the recipes
+	// produce (see OutputsRule).
+	Outputs []string `json:"outputs,omitempty"`
+
+	// Recipes are the fully expanded commands to run, after platform
+	// selection (see Config.SelectRecipes).
+	Recipes []string `json:"recipes,omitempty"`
+
+	Phony   bool `json:"phony,omitempty"`
+	Service bool `json:"service,omitempty"`
+}
+
+// Plan returns a Plan to build the targets that need to be built.
+func (m *Maker) Plan() (*Plan, error) {
+	targetSets, err := m.TargetSetsNeedingBuild()
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{TargetSets: make([][]PlannedTarget, len(targetSets))}
+	for i, targetSet := range targetSets {
+		p.TargetSets[i] = make([]PlannedTarget, len(targetSet))
+		for j, target := range targetSet {
+			rule := m.rule(target)
+			recipes := m.SelectRecipes(rule.Recipes())
+			for k, recipe := range recipes {
+				if recipes[k], err = m.expandRecipe(rule, recipe); err != nil {
+					return nil, fmt.Errorf("%s: expanding recipe failed: %s (%s)", target, recipe, err)
+				}
+			}
+			p.TargetSets[i][j] = PlannedTarget{
+				Target:  target,
+				Prereqs: rule.Prereqs(),
+				Outputs: ruleOutputs(rule)[1:],
+				Recipes: recipes,
+				Phony:   isPhony(m, target),
+				Service: isService(rule),
+			}
+		}
+	}
+	return p, nil
+}
+
+// SavePlan writes a Plan (see Maker.Plan) to w as JSON.
+func (m *Maker) SavePlan(w io.Writer) error {
+	p, err := m.Plan()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// LoadPlan reads a Plan that was written by Maker.SavePlan.
+func LoadPlan(r io.Reader) (*Plan, error) {
+	var p Plan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// RunPlan builds the targets in p by running the recipes recorded in p, one
+// target set at a time in p's order. Unlike Run, it doesn't check whether the
+// targets need to be built, and it doesn't use the Maker's makefile or goals,
+// which are left as they are. It uses the Maker's Config, RuleOutput, progress
+// channels, and Hooks.
+func (m *Maker) RunPlan(p *Plan) error {
+	mf := &Makefile{}
+	var goals, phony []string
+	targetSets := make([][]string, len(p.TargetSets))
+	forced := make(map[string]bool)
+	for i, targetSet := range p.TargetSets {
+		for _, t := range targetSet {
+			rule := &plannedRule{BasicRule{
+				TargetFile:  t.Target,
+				PrereqFiles: t.Prereqs,
+				RecipeCmds:  t.Recipes,
+				OutputFiles: t.Outputs,
+				Service:     t.Service,
+			}}
+			mf.Rules = append(mf.Rules, rule)
+			goals = append(goals, t.Target)
+			targetSets[i] = append(targetSets[i], t.Target)
+			forced[t.Target] = true
+			if t.Phony {
+				phony = append(phony, t.Target)
+			}
+		}
+	}
+	if len(phony) > 0 {
+		mf.Rules = append(mf.Rules, &BasicRule{TargetFile: ".PHONY", PrereqFiles: phony})
+	}
+
+	pm := m.Config.NewMaker(mf, goals...)
+	pm.RuleOutput = m.RuleOutput
+	pm.Started, pm.Ended, pm.Succeeded, pm.Failed = m.Started, m.Ended, m.Succeeded, m.Failed
+	pm.Hooks = m.Hooks
+	pm.planned = targetSets
+	pm.forced = forced
+	return pm.runSelected(context.Background(), nil)
+}
+
+// plannedNeedingBuild returns the target sets of the plan that m runs (see
+// RunPlan), in the plan's order, omitting the targets that an earlier attempt
+// of the current call to Run already built.
+func (m *Maker) plannedNeedingBuild() ([][]string, error) {
+	if err := m.checkGoals(); err != nil {
+		return nil, err
+	}
+	statuses := m.targetStatuses()
+	selected := make(map[string]bool)
+	for _, targetSet := range m.planned {
+		for _, target := range targetSet {
+			if statuses[target] != TargetBuilt {
+				selected[target] = true
+			}
+		}
+	}
+	return selectTargets(m.planned, selected), nil
+}
+
+// A plannedRule is a rule in a Plan. Its recipes are already expanded and
+// selected for the platform, so they are run as is.
+type plannedRule struct {
+	BasicRule
+}
@@ -0,0 +1,102 @@
+package makex
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_SavePlan_RunPlan(t *testing.T) {
+	mf, err := Parse([]byte(`
+X = v
+.PHONY: all
+all: x
+	@makex:call record all
+x:
+	@makex:call record $(X) $$HOME $@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{ParallelJobs: 1, FS: NewFileSystem(rwvfs.Map(map[string]string{}))}
+
+	var buf bytes.Buffer
+	if err := conf.NewMaker(mf, "all").SavePlan(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Plan{TargetSets: [][]PlannedTarget{
+		{{Target: "x", Recipes: []string{"@makex:call record v $HOME x"}}},
+		{{Target: "all", Prereqs: []string{"x"}, Recipes: []string{"@makex:call record all"}, Phony: true}},
+	}}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("got plan %+v, want %+v", p, want)
+	}
+
+	// Run the plan with a Maker for an unrelated makefile, to check that
+	// it is self-contained.
+	var calls [][]string
+	conf.Builtins = map[string]func(Rule, []string) error{
+		"record": func(_ Rule, args []string) error {
+			calls = append(calls, args)
+			return nil
+		},
+	}
+	other, err := Parse([]byte(`
+.PHONY: other
+other:
+	@makex:call record other
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(other, "other")
+	if err := mk.RunPlan(p); err != nil {
+		t.Fatal(err)
+	}
+	if wantCalls := [][]string{{"v", "$HOME", "x"}, {"all"}}; !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("got builtin calls %q, want %q", calls, wantCalls)
+	}
+
+	// Afterwards, the Maker still builds its own makefile's goals.
+	calls = nil
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if wantCalls := [][]string{{"other"}}; !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("got builtin calls %q after running the plan, want %q", calls, wantCalls)
+	}
+	if got := mk.Dependents("x"); len(got) != 0 {
+		t.Errorf("got dependents of x %v after running the plan, want none", got)
+	}
+}
+
+func TestMaker_RunPlan_order(t *testing.T) {
+	// The targets don't depend on each other, so a Maker would build them
+	// in one target set (in no particular order), but the plan builds
+	// them one at a time, in reverse alphabetical order.
+	want := []string{"f", "e", "d", "c", "b", "a"}
+	p := &Plan{}
+	for _, target := range want {
+		p.TargetSets = append(p.TargetSets, []PlannedTarget{{Target: target, Recipes: []string{"@makex:call record " + target}, Phony: true}})
+	}
+	var calls []string
+	conf := &Config{ParallelJobs: 1, FS: NewFileSystem(rwvfs.Map(map[string]string{}))}
+	conf.Builtins = map[string]func(Rule, []string) error{
+		"record": func(_ Rule, args []string) error {
+			calls = append(calls, args...)
+			return nil
+		},
+	}
+	if err := conf.NewMaker(&Makefile{}).RunPlan(p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got builtin calls %q, want %q", calls, want)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package makex
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on systems without Unix process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// setNice is a no-op on systems without Unix process priorities.
+func setNice(cmd *exec.Cmd, n int) error { return nil }
+
+// killProcessGroup kills the process started by cmd. On systems without Unix
+// process groups, processes that it started are not killed.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+// signalProcessGroup sends sig to the process started by cmd. On systems
+// without Unix process groups, processes that it started are not signaled.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Signal(sig)
+}
@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package makex
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd run in its own process group, so that
+// killProcessGroup can kill it along with any processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// setNice sets the niceness of the process started by cmd to n. Processes
+// that it already started are unaffected.
+func setNice(cmd *exec.Cmd, n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, cmd.Process.Pid, n)
+}
+
+// killProcessGroup kills the process started by cmd and the other processes
+// in its process group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// signalProcessGroup sends sig to the process started by cmd and the other
+// processes in its process group.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if sig, ok := sig.(syscall.Signal); ok {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
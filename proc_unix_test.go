@@ -0,0 +1,44 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package makex
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_nice(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Nice: func(r Rule) int {
+			if r.Target() == "docs" {
+				return 7
+			}
+			return 0
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"docs"}},
+		// Sleep first so that the niceness is set before ps runs.
+		&BasicRule{TargetFile: "docs", RecipeCmds: []string{"sleep 0.1; ps -o nice= -p $$"}},
+	}}
+	var stdout bytes.Buffer
+	mk := conf.NewMaker(mf, "docs")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{&stdout}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(stdout.String()); got != "7" {
+		t.Errorf("got niceness %q, want 7", got)
+	}
+}
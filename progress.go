@@ -0,0 +1,89 @@
+package makex
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Hooks receives notifications of build activity from Maker.Run, such as to
+// show a live progress display or to write a stream of build events. Targets
+// in the same target set are built in parallel, so the methods may be called
+// concurrently (from different goroutines) and must be safe for concurrent
+// use. They are called whether or not Maker.RuleOutput is set.
+type Hooks interface {
+	// OnTargetStart is called when target starts building.
+	OnTargetStart(target string)
+
+	// OnTargetSuccess is called when target was built successfully,
+	// which took dur.
+	OnTargetSuccess(target string, dur time.Duration)
+
+	// OnTargetFailure is called when building target failed with err.
+	OnTargetFailure(target string, err error)
+}
+
+// progress counts the targets built so far during a call to Run.
+type progress struct {
+	total                 int
+	done, running, failed int32
+	start                 time.Time
+}
+
+func newProgress(targetSets [][]string) *progress {
+	p := &progress{start: time.Now()}
+	for _, targetSet := range targetSets {
+		p.total += len(targetSet)
+	}
+	return p
+}
+
+func (p *progress) String() string {
+	return fmt.Sprintf("[makex] %d/%d done, %d running, %d failed, %s elapsed",
+		atomic.LoadInt32(&p.done), p.total, atomic.LoadInt32(&p.running), atomic.LoadInt32(&p.failed),
+		time.Since(p.start).Round(time.Second))
+}
+
+// warnIfSlow logs a warning to log if stop isn't called within
+// m.SlowTargetThreshold. No warning is logged after stop returns.
+func (m *Maker) warnIfSlow(rule Rule, log *log.Logger) (stop func()) {
+	timer := time.NewTimer(m.SlowTargetThreshold)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-timer.C:
+			log.Printf("%s is taking longer than expected (%s)", rule.Target(), m.SlowTargetThreshold)
+		case <-done:
+		}
+	}()
+	return func() {
+		timer.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// logSummaries logs a summary of p every m.SummaryInterval until stop is
+// called. No summaries are logged after stop returns.
+func (m *Maker) logSummaries(p *progress) (stop func()) {
+	ticker := time.NewTicker(m.SummaryInterval)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				m.logger().Print(p)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,134 @@
+package makex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestProgress_String(t *testing.T) {
+	p := &progress{total: 130, done: 42, running: 6, start: time.Now().Add(-192 * time.Second)}
+	if got, want := p.String(), "[makex] 42/130 done, 6 running, 0 failed, 3m12s elapsed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMaker_Run_summaryInterval(t *testing.T) {
+	var logBuf bytes.Buffer
+	conf := &Config{
+		ParallelJobs:    1,
+		FS:              NewFileSystem(rwvfs.Map(map[string]string{})),
+		SummaryInterval: 10 * time.Millisecond,
+		Log:             log.New(&logBuf, "", 0),
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"sleep 0.1"}},
+	}}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[makex] 0/1 done, 1 running, 0 failed, 0s elapsed\n"; !strings.Contains(logBuf.String(), want) {
+		t.Errorf("got log %q, want it to contain %q", logBuf.String(), want)
+	}
+}
+
+func TestMaker_Run_slowTargetThreshold(t *testing.T) {
+	conf := &Config{
+		ParallelJobs:        2,
+		FS:                  NewFileSystem(rwvfs.Map(map[string]string{})),
+		SlowTargetThreshold: 50 * time.Millisecond,
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"fast", "slow"}},
+		&BasicRule{TargetFile: "fast", RecipeCmds: []string{"true"}},
+		&BasicRule{TargetFile: "slow", RecipeCmds: []string{"sleep 0.3"}},
+	}}
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+	mk := conf.NewMaker(mf, "fast", "slow")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, logger
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "slow is taking longer than expected (50ms)\n"; logBuf.String() != want {
+		t.Errorf("got log %q, want %q", logBuf.String(), want)
+	}
+}
+
+// recordingHooks records the events it is notified of.
+type recordingHooks struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *recordingHooks) OnTargetStart(target string) { h.record("start " + target) }
+
+func (h *recordingHooks) OnTargetSuccess(target string, dur time.Duration) {
+	if dur <= 0 {
+		h.record("success with no duration " + target)
+		return
+	}
+	h.record("success " + target)
+}
+
+func (h *recordingHooks) OnTargetFailure(target string, err error) {
+	h.record("failure " + target + ": " + err.Error())
+}
+
+func TestMaker_Run_hooks(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Builtins: map[string]func(Rule, []string) error{
+			"fail": func(Rule, []string) error { return errors.New("failed") },
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"a", "b"}},
+		&BasicRule{TargetFile: "a", RecipeCmds: []string{"sleep 0.01"}},
+		&BasicRule{TargetFile: "b", RecipeCmds: []string{"@makex:call fail"}},
+	}}
+	var hooks recordingHooks
+	mk := conf.NewMaker(mf, "a", "b")
+	mk.Hooks = &hooks
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err == nil {
+		t.Error("got no error from failed recipe")
+	}
+
+	sort.Strings(hooks.events)
+	want := []string{
+		"failure b: recipe 1 of 1 for target b failed: @makex:call fail (failed)",
+		"start a",
+		"start b",
+		"success a",
+	}
+	if !reflect.DeepEqual(hooks.events, want) {
+		t.Errorf("got events %q, want %q", hooks.events, want)
+	}
+}
@@ -0,0 +1,82 @@
+package makex
+
+import (
+	"crypto/sha1"
+	"io"
+	"time"
+)
+
+// outputsHash returns a hash of the contents of rule's outputs, or nil if
+// rule is phony or a service or any of its outputs can't be read (see
+// Config.Restat).
+func (m *Maker) outputsHash(rule Rule) []byte {
+	if isPhony(m, rule.Target()) || isService(rule) {
+		return nil
+	}
+	h := sha1.New()
+	for _, output := range ruleOutputs(rule) {
+		f, err := m.fs().Open(output)
+		if err != nil {
+			return nil
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil
+		}
+		// Separate the outputs so that moving bytes from one output
+		// to the next changes the hash.
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// markUnchanged records that target's contents are unchanged in the current
+// build, so that its dependents don't consider it newer than them.
+func (m *Maker) markUnchanged(target string) {
+	m.unchangedMu.Lock()
+	defer m.unchangedMu.Unlock()
+	if m.unchanged == nil {
+		m.unchanged = make(map[string]bool)
+	}
+	m.unchanged[target] = true
+}
+
+// isUnchanged reports whether target's contents are unchanged in the current
+// build (see markUnchanged).
+func (m *Maker) isUnchanged(target string) bool {
+	m.unchangedMu.Lock()
+	defer m.unchangedMu.Unlock()
+	return m.unchanged[target]
+}
+
+// restatSkip reports whether target, which was stale when the build started,
+// is now up to date because the prereqs that made it stale were rebuilt
+// without changing their contents. If so, target is marked unchanged (so that
+// its own dependents can be skipped too) and its outputs' mtimes are updated.
+func (m *Maker) restatSkip(target string) bool {
+	m.unchangedMu.Lock()
+	none := len(m.unchanged) == 0
+	m.unchangedMu.Unlock()
+	if none {
+		return false
+	}
+
+	if stale, err := m.isStale(target); err != nil || stale {
+		return false
+	}
+	m.markUnchanged(target)
+	if ct, ok := m.fs().(Chtimeser); ok {
+		now := time.Now()
+		for _, output := range ruleOutputs(m.rule(target)) {
+			if err := ct.Chtimes(output, now, now); err != nil {
+				m.logger().Printf("%s: updating mtime of %s failed: %s", target, output, err)
+			}
+			m.invalidateStats(output)
+		}
+	}
+	if m.Verbose {
+		m.logger().Printf("%s: prereqs are unchanged; skipping", target)
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package makex
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMaker_Run_restat(t *testing.T) {
+	for _, restat := range []bool{false, true} {
+		tmpDir, err := ioutil.TempDir("", "makex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		// gen.in is newer than y, which is newer than x and z, so all of
+		// them are stale.
+		base := time.Now().Add(-time.Hour)
+		for i, file := range []string{"x", "z", "y", "gen.in"} {
+			path := filepath.Join(tmpDir, file)
+			if err := ioutil.WriteFile(path, []byte("same"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			mtime := base.Add(time.Duration(i) * time.Minute)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fs := NewOSFileSystem(tmpDir)
+		var built []string
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           fs,
+			Restat:       restat,
+			Builtins: map[string]func(Rule, []string) error{
+				"write": func(rule Rule, args []string) error {
+					built = append(built, rule.Target())
+					w, err := fs.Create(rule.Target())
+					if err != nil {
+						return err
+					}
+					defer w.Close()
+					_, err = io.WriteString(w, args[0])
+					return err
+				},
+			},
+		}
+		mf := &Makefile{Rules: []Rule{
+			&BasicRule{TargetFile: "x", PrereqFiles: []string{"y"}, RecipeCmds: []string{"@makex:call write x"}},
+			&BasicRule{TargetFile: "y", PrereqFiles: []string{"gen.in"}, RecipeCmds: []string{"@makex:call write same"}},
+			&BasicRule{TargetFile: "z", PrereqFiles: []string{"gen.in", "y"}, RecipeCmds: []string{"@makex:call write z"}},
+		}}
+		mk := conf.NewMaker(mf, "x", "z")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+		if err := mk.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		// z is still stale because of gen.in.
+		want := []string{"y", "x", "z"}
+		if restat {
+			want = []string{"y", "z"}
+		}
+		if len(built) > 1 {
+			// x and z are in the same target set.
+			sort.Strings(built[1:])
+		}
+		if !reflect.DeepEqual(built, want) {
+			t.Errorf("Restat=%v: got built %v, want %v", restat, built, want)
+		}
+
+		if restat {
+			targetSets, err := conf.NewMaker(mf, "x", "z").TargetSetsNeedingBuild()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(targetSets) != 0 {
+				t.Errorf("Restat=%v: got target sets %v needing build after build, want none", restat, targetSets)
+			}
+		}
+	}
+}
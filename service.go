@@ -0,0 +1,190 @@
+package makex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// A ServiceRule is a Rule whose target is a service (such as a mock server or
+// a database) that must be running while the targets that depend on it are
+// built, rather than a file.
+//
+// All but the last of a service's recipes are run as usual. The last recipe
+// must not exit; it is started in the background, and once Config.Readiness
+// reports that the service is ready, the targets that depend on it are built.
+// Services are stopped (and their processes killed) when Run returns.
+//
+// A service is started only if it is a goal or if a target that depends on it
+// needs to be built. A service never makes the targets that depend on it stale.
+type ServiceRule interface {
+	Rule
+
+	// IsService returns whether the rule's target is a service.
+	IsService() bool
+}
+
+// isService returns whether rule is a ServiceRule whose target is a service.
+func isService(rule Rule) bool {
+	r, ok := rule.(ServiceRule)
+	return ok && r.IsService()
+}
+
+// readinessPollInterval is how often a starting service's readiness is
+// checked.
+var readinessPollInterval = 100 * time.Millisecond
+
+// defaultReadinessTimeout is used if Config.ReadinessTimeout is zero.
+const defaultReadinessTimeout = 30 * time.Second
+
+// A service is a running service target.
+type service struct {
+	rule           Rule
+	cmd            *exec.Cmd
+	done           chan struct{} // closed when the process exits
+	stdout, stderr io.Closer
+}
+
+// startService starts recipe (the last recipe of service rule) in the
+// background and waits for the service to become ready. If the service starts
+// successfully, it is stopped by stopServices, which closes stdout and stderr.
+func (m *Maker) startService(rule Rule, recipe string, stdout, stderr io.WriteCloser) error {
+	if _, _, ok := parseBuiltinCall(recipe); ok {
+		return errors.New("a service's last recipe can't call a builtin")
+	}
+	cmd, err := m.shellCommand(recipe)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	setProcessGroup(cmd)
+	if err := m.startCmd(rule, cmd); err != nil {
+		return err
+	}
+	svc := &service{rule: rule, cmd: cmd, done: make(chan struct{}), stdout: stdout, stderr: stderr}
+	go func() {
+		cmd.Wait()
+		close(svc.done)
+	}()
+
+	if err := m.waitForReadiness(svc); err != nil {
+		killProcessGroup(cmd)
+		<-svc.done
+		return err
+	}
+
+	m.servicesMu.Lock()
+	m.services = append(m.services, svc)
+	m.servicesMu.Unlock()
+	return nil
+}
+
+// waitForReadiness polls Config.Readiness until it reports that svc is
+// ready, svc exits, or Config.ReadinessTimeout elapses.
+func (m *Maker) waitForReadiness(svc *service) error {
+	timeout := m.ReadinessTimeout
+	if timeout == 0 {
+		timeout = defaultReadinessTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-svc.done:
+			return errors.New("service exited before it was ready")
+		default:
+		}
+		if m.Readiness == nil {
+			return nil
+		}
+		err := m.Readiness(svc.rule)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service not ready after %s (%s)", timeout, err)
+		}
+		time.Sleep(readinessPollInterval)
+	}
+}
+
+// isRunningService returns whether rule is a service that was started during
+// the current Run and hasn't yet been stopped.
+func (m *Maker) isRunningService(rule Rule) bool {
+	m.servicesMu.Lock()
+	defer m.servicesMu.Unlock()
+	for _, svc := range m.services {
+		if svc.rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// stopServices stops the services started during the current Run, in the
+// reverse of the order they were started in.
+func (m *Maker) stopServices() {
+	m.servicesMu.Lock()
+	services := m.services
+	m.services = nil
+	m.servicesMu.Unlock()
+
+	for i := len(services) - 1; i >= 0; i-- {
+		svc := services[i]
+		killProcessGroup(svc.cmd)
+		<-svc.done
+		svc.stdout.Close()
+		svc.stderr.Close()
+		if m.Verbose {
+			m.logger().Printf("stopped service %s", svc.rule.Target())
+		}
+	}
+}
+
+// withoutUnneededServices removes from targetSets the services that aren't
+// goals and that no other target in targetSets depends on.
+func (m *Maker) withoutUnneededServices(targetSets [][]string) [][]string {
+	needed := make(map[string]bool)
+	for _, targetSet := range targetSets {
+		for _, target := range targetSet {
+			needed[target] = true
+		}
+	}
+	isGoal := make(map[string]bool, len(m.goals))
+	for _, goal := range m.goals {
+		isGoal[goal] = true
+	}
+
+	// Dependents come after their prereqs, so walk backwards to decide
+	// about dependents (which may themselves be services) first.
+	for i := len(targetSets) - 1; i >= 0; i-- {
+		for _, target := range targetSets[i] {
+			if isGoal[target] || !isService(m.rule(target)) {
+				continue
+			}
+			hasDependent := false
+			for _, dependent := range m.dependents[target] {
+				if needed[dependent] {
+					hasDependent = true
+					break
+				}
+			}
+			needed[target] = hasDependent
+		}
+	}
+
+	filtered := make([][]string, 0, len(targetSets))
+	for _, targetSet := range targetSets {
+		var targets []string
+		for _, target := range targetSet {
+			if needed[target] {
+				targets = append(targets, target)
+			}
+		}
+		if len(targets) > 0 {
+			filtered = append(filtered, targets)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,89 @@
+package makex
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_service(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	started := filepath.Join(tmpDir, "started")
+
+	var sawService bool
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+		Readiness: func(r Rule) error {
+			if _, err := os.Stat(started); err != nil {
+				return err
+			}
+			return nil
+		},
+		Builtins: map[string]func(Rule, []string) error{
+			"check": func(Rule, []string) error {
+				if _, err := os.Stat(started); err != nil {
+					return errors.New("service is not running")
+				}
+				sawService = true
+				return nil
+			},
+		},
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: "test", PrereqFiles: []string{"server"}, RecipeCmds: []string{"@makex:call check"}},
+			&BasicRule{TargetFile: "server", Service: true, RecipeCmds: []string{
+				fmt.Sprintf("touch %s && exec sleep 60", filepath.ToSlash(started)),
+			}},
+		},
+	}
+
+	start := time.Now()
+	if err := conf.NewMaker(mf, "test").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !sawService {
+		t.Error("dependent of service did not run")
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("Run took %s; service was not stopped", d)
+	}
+}
+
+func TestMaker_withoutUnneededServices(t *testing.T) {
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: "test", PrereqFiles: []string{"server"}},
+			&BasicRule{TargetFile: "server", Service: true},
+		},
+	}
+	conf := &Config{FS: NewFileSystem(rwvfs.Map(map[string]string{"test": ""}))}
+
+	targetSets, err := conf.NewMaker(mf, "test").TargetSetsNeedingBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{}; !reflect.DeepEqual(targetSets, want) {
+		t.Errorf("got target sets %v, want %v (service shouldn't start if its dependents are up to date)", targetSets, want)
+	}
+
+	targetSets, err = conf.NewMaker(mf, "server").TargetSetsNeedingBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"server"}}; !reflect.DeepEqual(targetSets, want) {
+		t.Errorf("got target sets %v, want %v (service goals should always start)", targetSets, want)
+	}
+}
@@ -0,0 +1,113 @@
+package makex
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// DefaultShell returns the shell command and flags that recipes are run with
+// (with the recipe appended as the last argument) if neither Config.Shell nor
+// the makefile's SHELL variable is set.
+//
+// On Windows, it is the shell named by the SHELL environment variable (such
+// as the bash of Git for Windows), or else by the ComSpec environment variable
+// (usually cmd.exe), or else "cmd". The flag is "/C" for cmd, "-Command" for
+// PowerShell (powershell or pwsh), and "-c" otherwise. On other systems, it is
+// always "sh -c", because (as in GNU make) the SHELL environment variable is
+// the user's interactive shell, which recipes aren't written for.
+func DefaultShell() []string { return platformShell(runtime.GOOS, os.Getenv) }
+
+func platformShell(goos string, getenv func(string) string) []string {
+	if goos != "windows" {
+		return []string{"sh", "-c"}
+	}
+	for _, name := range []string{"SHELL", "ComSpec"} {
+		if sh := getenv(name); sh != "" {
+			return []string{sh, shellFlag(sh)}
+		}
+	}
+	return []string{"cmd", "/C"}
+}
+
+// shellFlag returns the flag that makes shell run the command given as its
+// next argument.
+func shellFlag(shell string) string {
+	name := strings.ToLower(shell[strings.LastIndexAny(shell, `/\`)+1:])
+	switch strings.TrimSuffix(name, ".exe") {
+	case "cmd":
+		return "/C"
+	case "powershell", "pwsh":
+		return "-Command"
+	}
+	return "-c"
+}
+
+// shell returns the shell command and flags that m runs recipes with. It is
+// the first of:
+//
+//  1. m.Shell, if set
+//  2. the makefile's SHELL variable, if defined (with the flags in its
+//     .SHELLFLAGS variable, if defined, or else the flag that suits
+//     the shell, as in DefaultShell)
+//  3. DefaultShell()
+func (m *Maker) shell() ([]string, error) {
+	if len(m.Shell) > 0 {
+		if err := m.checkShell(); err != nil {
+			return nil, err
+		}
+		return m.Shell, nil
+	}
+	if _, ok := m.mf.Vars["SHELL"]; ok {
+		x := m.mf.newExpander()
+		sh, err := x.lookup("SHELL")
+		if err != nil {
+			return nil, fmt.Errorf("expanding SHELL failed: %s", err)
+		}
+		if sh = strings.TrimSpace(sh); sh != "" {
+			if _, ok := m.mf.Vars[".SHELLFLAGS"]; !ok {
+				return []string{sh, shellFlag(sh)}, nil
+			}
+			flags, err := x.lookup(".SHELLFLAGS")
+			if err != nil {
+				return nil, fmt.Errorf("expanding .SHELLFLAGS failed: %s", err)
+			}
+			return append([]string{sh}, strings.Fields(flags)...), nil
+		}
+	}
+	return DefaultShell(), nil
+}
+
+// checkShell returns an error if m.Shell is set but its first element (the
+// shell command) is empty. It is called before each build, so that the build
+// fails up front instead of when each recipe is run.
+func (m *Maker) checkShell() error {
+	if len(m.Shell) > 0 && strings.TrimSpace(m.Shell[0]) == "" {
+		return fmt.Errorf("shell command is empty (Config.Shell is %q)", m.Shell)
+	}
+	return nil
+}
+
+// shellCommand returns a command that runs recipe in m's shell, which is run
+// by the wrapper command (such as "fakeroot"), if any.
+func (m *Maker) shellCommand(recipe string, wrapper ...string) (*exec.Cmd, error) {
+	sh, err := m.shell()
+	if err != nil {
+		return nil, err
+	}
+	args := append(append(append([]string{}, wrapper...), sh...), recipe)
+	return exec.CommandContext(m.context(), args[0], args[1:]...), nil
+}
+
+// runShell runs cmd in m's shell and returns its output, for "$(shell ...)"
+// function calls in recipes.
+func (m *Maker) runShell(cmd string) ([]byte, error) {
+	c, err := m.shellCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	c.Env = m.recipeEnv()
+	return c.Output()
+}
@@ -0,0 +1,113 @@
+package makex
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestPlatformShell(t *testing.T) {
+	tests := []struct {
+		goos string
+		env  map[string]string
+		want []string
+	}{
+		{"linux", map[string]string{"SHELL": "/bin/zsh"}, []string{"sh", "-c"}},
+		{"windows", nil, []string{"cmd", "/C"}},
+		{"windows", map[string]string{"ComSpec": `C:\Windows\system32\cmd.exe`}, []string{`C:\Windows\system32\cmd.exe`, "/C"}},
+		{"windows", map[string]string{"ComSpec": `C:\Windows\system32\cmd.exe`, "SHELL": `C:\Program Files\Git\bin\bash.exe`}, []string{`C:\Program Files\Git\bin\bash.exe`, "-c"}},
+		{"windows", map[string]string{"SHELL": "pwsh"}, []string{"pwsh", "-Command"}},
+		{"windows", map[string]string{"ComSpec": `C:\WINDOWS\PowerShell.EXE`}, []string{`C:\WINDOWS\PowerShell.EXE`, "-Command"}},
+	}
+	for _, test := range tests {
+		got := platformShell(test.goos, func(name string) string { return test.env[name] })
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %v: got %q, want %q", test.goos, test.env, got, test.want)
+		}
+	}
+}
+
+func TestMaker_shell(t *testing.T) {
+	tests := map[string]struct {
+		shell []string
+		vars  map[string]*Var
+		want  []string
+	}{
+		"default":        {want: DefaultShell()},
+		"config":         {shell: []string{"bash", "-ec"}, vars: map[string]*Var{"SHELL": {Value: "zsh"}}, want: []string{"bash", "-ec"}},
+		"makefile":       {vars: map[string]*Var{"SHELL": {Value: "$(B)"}, "B": {Value: "/bin/bash"}}, want: []string{"/bin/bash", "-c"}},
+		"makefile cmd":   {vars: map[string]*Var{"SHELL": {Value: "cmd.exe"}}, want: []string{"cmd.exe", "/C"}},
+		"makefile flags": {vars: map[string]*Var{"SHELL": {Value: "bash"}, ".SHELLFLAGS": {Value: "-eu -o pipefail -c"}}, want: []string{"bash", "-eu", "-o", "pipefail", "-c"}},
+		"empty makefile": {vars: map[string]*Var{"SHELL": {Value: " "}}, want: DefaultShell()},
+	}
+	for label, test := range tests {
+		conf := &Config{Shell: test.shell}
+		mk := conf.NewMaker(&Makefile{Vars: test.vars})
+		got, err := mk.shell()
+		if err != nil {
+			t.Errorf("%s: %s", label, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got shell %q, want %q", label, got, test.want)
+		}
+	}
+}
+
+func TestMaker_Run_shell(t *testing.T) {
+	var out bytes.Buffer
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Shell:        []string{"sh", "-c", `echo "[$0] $1"`, "myshell"},
+	}
+	mf, err := Parse([]byte(`
+.PHONY: x
+x:
+	echo $(shell hi)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, "x")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{&out}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[myshell] echo [myshell] hi\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
+
+func TestMaker_Run_emptyShell(t *testing.T) {
+	calls := 0
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Shell:        []string{"", "-c"},
+		Builtins: map[string]func(Rule, []string) error{
+			"count": func(Rule, []string) error {
+				calls++
+				return nil
+			},
+		},
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"x"}},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"@makex:call count"}},
+	}}
+	err := conf.NewMaker(mf, "x").Run()
+	if want := `shell command is empty (Config.Shell is ["" "-c"])`; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	if calls != 0 {
+		t.Errorf("got %d recipes run, want none", calls)
+	}
+}
@@ -0,0 +1,236 @@
+package makex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrInterrupted is returned by Maker.Run when the build was stopped by an
+// interrupt signal (see Config.GracePeriod).
+var ErrInterrupted = errors.New("build interrupted")
+
+// handleSignals handles interrupt (SIGINT and SIGTERM) signals received during
+// a build, until stop is called. The first signal stops the build from
+// starting new targets, and the running recipes are given m.GracePeriod to
+// finish. A second signal, or the end of the grace period, kills the running
+// recipes (which then fail, so their targets are removed).
+func (m *Maker) handleSignals() (stop func()) {
+	sigs := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+		case <-done:
+			return
+		}
+		atomic.StoreInt32(&m.interrupted, 1)
+		m.logger().Printf("interrupted; waiting up to %s for running recipes to finish (interrupt again to stop them now)", m.GracePeriod)
+
+		grace := time.NewTimer(m.GracePeriod)
+		defer grace.Stop()
+		select {
+		case <-sigs:
+		case <-grace.C:
+		case <-done:
+			return
+		}
+		m.logger().Print("stopping running recipes")
+		m.killProcs()
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// forwardSignals forwards interrupt (SIGINT and SIGTERM) signals received
+// during a build to the running recipes' process groups, until stop is called.
+// It is used instead of handleSignals when recipes are run in their own
+// process groups (see usesProcessGroups) but m.GracePeriod isn't set, so that
+// interrupts (such as from Ctrl-C) still reach the recipes. The first signal
+// also stops the build from starting new targets.
+func (m *Maker) forwardSignals() (stop func()) {
+	sigs := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				atomic.StoreInt32(&m.interrupted, 1)
+				m.logger().Printf("interrupted; forwarding %s to running recipes", sig)
+				m.signalProcs(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// handleCancel stops the build when the context of the current call to Run is
+// done, until stop is called. Like a second interrupt signal (see
+// handleSignals), it stops the build from starting new targets and kills the
+// running recipes' process groups. (The commands' own processes are also
+// killed by exec.CommandContext.)
+func (m *Maker) handleCancel() (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-m.context().Done():
+		case <-done:
+			return
+		}
+		atomic.StoreInt32(&m.interrupted, 1)
+		m.logger().Printf("build canceled (%s); stopping running recipes", m.context().Err())
+		m.killProcs()
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// context returns the context of the current call to Run, or
+// context.Background() if there is none.
+func (m *Maker) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// A CanceledError is returned by Maker.RunContext when its context is done
+// before the build finishes.
+type CanceledError struct {
+	// Err is the context's error (context.Canceled or
+	// context.DeadlineExceeded).
+	Err error
+
+	// Targets are the targets that were interrupted: those whose recipes
+	// were killed and those that hadn't been started yet, sorted by name.
+	Targets []string
+}
+
+func (e *CanceledError) Error() string {
+	if len(e.Targets) == 0 {
+		return fmt.Sprintf("build canceled: %s", e.Err)
+	}
+	return fmt.Sprintf("build canceled: %s (interrupted targets: %s)", e.Err, strings.Join(e.Targets, ", "))
+}
+
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+// errCanceled returns a *CanceledError for a build whose context is done
+// (with err), marking the targets that weren't built as interrupted.
+func (m *Maker) errCanceled(err error) error {
+	m.errInterrupted()
+	var targets []string
+	for target, status := range m.targetStatuses() {
+		if status == TargetInterrupted {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	return &CanceledError{Err: err, Targets: targets}
+}
+
+// isInterrupted reports whether the build received an interrupt signal.
+func (m *Maker) isInterrupted() bool {
+	return atomic.LoadInt32(&m.interrupted) == 1
+}
+
+// usesProcessGroups reports whether recipes are run by runCmd in their own
+// process groups, so that the processes they start can be killed with them:
+// when m.GracePeriod or m.RecipeTimeout is set, or when the context of the
+// current call to Run can be canceled. Interrupt signals are then handled by
+// handleSignals or forwarded to the recipes by forwardSignals.
+func (m *Maker) usesProcessGroups() bool {
+	return m.GracePeriod > 0 || m.RecipeTimeout > 0 || m.context().Done() != nil
+}
+
+// runCmd runs cmd (one of rule's recipes) in its own process group (see
+// usesProcessGroups) and tracks it so that killProcs can kill it. If
+// m.RecipeTimeout is set and cmd runs longer, its process group is killed, and
+// runCmd returns a *RecipeTimeoutError (unless the build was canceled or
+// interrupted first).
+func (m *Maker) runCmd(rule Rule, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	m.procsMu.Lock()
+	if m.procsKilled {
+		m.procsMu.Unlock()
+		return ErrInterrupted
+	}
+	if err := m.startCmd(rule, cmd); err != nil {
+		m.procsMu.Unlock()
+		return err
+	}
+	if m.procs == nil {
+		m.procs = make(map[*exec.Cmd]struct{})
+	}
+	m.procs[cmd] = struct{}{}
+	m.procsMu.Unlock()
+
+	var timedOut bool // guarded by m.procsMu
+	if m.RecipeTimeout > 0 {
+		ctx := m.context()
+		timer := time.AfterFunc(m.RecipeTimeout, func() {
+			m.procsMu.Lock()
+			defer m.procsMu.Unlock()
+			// A command that was already killed because the build
+			// was canceled or interrupted may not have exited yet.
+			if _, running := m.procs[cmd]; running && !m.procsKilled && ctx.Err() == nil {
+				timedOut = true
+				killProcessGroup(cmd)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	err := cmd.Wait()
+
+	m.procsMu.Lock()
+	delete(m.procs, cmd)
+	if timedOut {
+		err = &RecipeTimeoutError{Timeout: m.RecipeTimeout}
+	}
+	m.procsMu.Unlock()
+	return err
+}
+
+// killProcs kills the commands being run by runCmd and prevents it from
+// starting new ones.
+func (m *Maker) killProcs() {
+	m.procsMu.Lock()
+	defer m.procsMu.Unlock()
+	m.procsKilled = true
+	for cmd := range m.procs {
+		killProcessGroup(cmd)
+	}
+}
+
+// signalProcs sends sig to the process groups of the commands being run by
+// runCmd and prevents it from starting new ones.
+func (m *Maker) signalProcs(sig os.Signal) {
+	m.procsMu.Lock()
+	defer m.procsMu.Unlock()
+	m.procsKilled = true
+	for cmd := range m.procs {
+		signalProcessGroup(cmd, sig)
+	}
+}
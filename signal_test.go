@@ -0,0 +1,297 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package makex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Run_interrupt(t *testing.T) {
+	tests := map[string]struct {
+		recipe      string
+		signals     int
+		wantCreated bool
+	}{
+		"recipe finishes within grace period": {
+			recipe:      "sleep 0.5; touch %s",
+			signals:     1,
+			wantCreated: true,
+		},
+		"second signal kills recipe": {
+			recipe:  "touch %s; sleep 10",
+			signals: 2,
+		},
+	}
+	for label, test := range tests {
+		tmpDir, err := ioutil.TempDir("", "makex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+			GracePeriod:  5 * time.Second,
+			Log:          log.New(ioutil.Discard, "", 0),
+		}
+		mf := &Makefile{Rules: []Rule{
+			&BasicRule{TargetFile: "next", PrereqFiles: []string{"x"}, RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "next")}},
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{fmt.Sprintf(test.recipe, filepath.Join(tmpDir, "x"))}},
+		}}
+		mk := conf.NewMaker(mf, "next")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+
+		signals := test.signals
+		go func() {
+			for i := 0; i < signals; i++ {
+				time.Sleep(200 * time.Millisecond)
+				syscall.Kill(os.Getpid(), syscall.SIGTERM)
+			}
+		}()
+		start := time.Now()
+		err = mk.Run()
+		if err == nil {
+			t.Errorf("%s: got no error from interrupted build", label)
+		}
+		if d := time.Since(start); d > 4*time.Second {
+			t.Errorf("%s: Run took %s", label, d)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, "x")); (err == nil) != test.wantCreated {
+			t.Errorf("%s: got x exists %v, want %v", label, err == nil, test.wantCreated)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, "next")); err == nil {
+			t.Errorf("%s: target was built after interrupt", label)
+		}
+	}
+}
+
+func TestMaker_RunContext(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "makex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+		Log:          log.New(ioutil.Discard, "", 0),
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "next", PrereqFiles: []string{"x", "y"}, RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "next")}},
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "x") + "; sleep 10"}},
+		&BasicRule{TargetFile: "y", RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "y")}},
+	}}
+	mk := conf.NewMaker(mf, "next")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = mk.RunContext(ctx)
+	if d := time.Since(start); d > 4*time.Second {
+		t.Errorf("RunContext took %s", d)
+	}
+	cerr, ok := err.(*CanceledError)
+	if !ok {
+		t.Fatalf("got error %v, want *CanceledError", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want it to wrap context.DeadlineExceeded", err)
+	}
+	if want := []string{"next", "x"}; !reflect.DeepEqual(cerr.Targets, want) {
+		t.Errorf("got interrupted targets %v, want %v", cerr.Targets, want)
+	}
+	for file, wantExists := range map[string]bool{"x": false, "y": true, "next": false} {
+		if _, err := os.Stat(filepath.Join(tmpDir, file)); (err == nil) != wantExists {
+			t.Errorf("got %s exists %v, want %v", file, err == nil, wantExists)
+		}
+	}
+}
+
+func TestMaker_Run_recipeTimeout(t *testing.T) {
+	for _, cancelFirst := range []bool{false, true} {
+		tmpDir, err := ioutil.TempDir("", "makex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		conf := &Config{
+			ParallelJobs:  2,
+			FS:            NewFileSystem(rwvfs.OS(tmpDir)),
+			Log:           log.New(ioutil.Discard, "", 0),
+			RecipeTimeout: 200 * time.Millisecond,
+		}
+		ctx := context.Background()
+		if cancelFirst {
+			conf.RecipeTimeout = 5 * time.Second
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+			defer cancel()
+		}
+		mf := &Makefile{Rules: []Rule{
+			&BasicRule{TargetFile: "all", PrereqFiles: []string{"x", "y"}},
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "x") + "; sleep 10"}},
+			&BasicRule{TargetFile: "y", RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "y")}},
+		}}
+		mk := conf.NewMaker(mf, "all")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+
+		start := time.Now()
+		err = mk.RunContext(ctx)
+		if d := time.Since(start); d > 4*time.Second {
+			t.Errorf("cancelFirst=%v: Run took %s", cancelFirst, d)
+		}
+		var timeoutErr *RecipeTimeoutError
+		if cancelFirst {
+			if _, ok := err.(*CanceledError); !ok {
+				t.Errorf("cancelFirst=%v: got error %v, want *CanceledError", cancelFirst, err)
+			}
+			if errors.As(err, &timeoutErr) {
+				t.Errorf("cancelFirst=%v: got error %v, want no *RecipeTimeoutError", cancelFirst, err)
+			}
+		} else {
+			var recipeErr *RecipeError
+			if !errors.As(err, &recipeErr) || recipeErr.Target != "x" || !errors.As(err, &timeoutErr) {
+				t.Fatalf("cancelFirst=%v: got error %v, want a *RecipeError for x with a *RecipeTimeoutError", cancelFirst, err)
+			}
+			if want := "recipe 1 of 1 for target x failed: " + recipeErr.Recipe + " (timed out after 200ms (Config.RecipeTimeout))"; err.Error() != want {
+				t.Errorf("cancelFirst=%v: got error %q, want %q", cancelFirst, err, want)
+			}
+			if got := mk.Result().Status("x"); got != TargetFailed {
+				t.Errorf("cancelFirst=%v: got x status %s, want %s", cancelFirst, got, TargetFailed)
+			}
+		}
+		for file, wantExists := range map[string]bool{"x": false, "y": true} {
+			if _, err := os.Stat(filepath.Join(tmpDir, file)); (err == nil) != wantExists {
+				t.Errorf("cancelFirst=%v: got %s exists %v, want %v", cancelFirst, file, err == nil, wantExists)
+			}
+		}
+	}
+}
+
+func TestMaker_Run_forwardSignals(t *testing.T) {
+	// With RecipeTimeout set or a cancelable context, recipes run in their
+	// own process groups, so they only receive interrupts because makex
+	// forwards them.
+	for _, cancelable := range []bool{false, true} {
+		tmpDir, err := ioutil.TempDir("", "makex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		conf := &Config{
+			ParallelJobs: 1,
+			FS:           NewFileSystem(rwvfs.OS(tmpDir)),
+			Log:          log.New(ioutil.Discard, "", 0),
+		}
+		ctx := context.Background()
+		if cancelable {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(ctx)
+			defer cancel()
+		} else {
+			conf.RecipeTimeout = 10 * time.Second
+		}
+		mf := &Makefile{Rules: []Rule{
+			&BasicRule{TargetFile: "next", PrereqFiles: []string{"x"}, RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "next")}},
+			&BasicRule{TargetFile: "x", RecipeCmds: []string{"touch " + filepath.Join(tmpDir, "x") + "; sleep 10"}},
+		}}
+		mk := conf.NewMaker(mf, "next")
+		mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+			return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+		}
+
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		}()
+		start := time.Now()
+		err = mk.RunContext(ctx)
+		if err == nil {
+			t.Errorf("cancelable=%v: got no error from interrupted build", cancelable)
+		}
+		var timeoutErr *RecipeTimeoutError
+		if errors.As(err, &timeoutErr) {
+			t.Errorf("cancelable=%v: got error %v, want no *RecipeTimeoutError", cancelable, err)
+		}
+		if d := time.Since(start); d > 4*time.Second {
+			t.Errorf("cancelable=%v: Run took %s", cancelable, d)
+		}
+		for file, wantExists := range map[string]bool{"x": false, "next": false} {
+			if _, err := os.Stat(filepath.Join(tmpDir, file)); (err == nil) != wantExists {
+				t.Errorf("cancelable=%v: got %s exists %v, want %v", cancelable, file, err == nil, wantExists)
+			}
+		}
+	}
+}
+
+// A blockingWriter blocks writes until release is closed.
+type blockingWriter struct{ release chan struct{} }
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func (w blockingWriter) Close() error { return nil }
+
+func TestMaker_Run_recipeTimeoutAfterCancel(t *testing.T) {
+	conf := &Config{
+		ParallelJobs:  1,
+		FS:            NewFileSystem(rwvfs.Map(map[string]string{})),
+		Log:           log.New(ioutil.Discard, "", 0),
+		RecipeTimeout: 300 * time.Millisecond,
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "x", RecipeCmds: []string{"echo x; sleep 10"}},
+	}}
+	mk := conf.NewMaker(mf, "x")
+	// The recipe is killed when the build is canceled, before the timeout,
+	// but it isn't reaped until its output is written, after the timeout.
+	release := make(chan struct{})
+	time.AfterFunc(600*time.Millisecond, func() { close(release) })
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return blockingWriter{release}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	failed := make(chan RuleBuildError, 1)
+	mk.Failed = failed
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := mk.RunContext(ctx); !errors.As(err, new(*CanceledError)) {
+		t.Errorf("got error %v, want *CanceledError", err)
+	}
+	select {
+	case err := <-failed:
+		var timeoutErr *RecipeTimeoutError
+		if errors.As(err, &timeoutErr) {
+			t.Errorf("got target error %v, want no *RecipeTimeoutError", err)
+		}
+	default:
+		t.Error("got no target error")
+	}
+}
@@ -0,0 +1,80 @@
+package makex
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A statResult is a cached result of calling Stat on m's filesystem.
+type statResult struct {
+	fi  os.FileInfo
+	err error
+}
+
+// startStatCache starts caching the results of calls to Stat (unless
+// m.DisableStatCache is set) until the returned func is called. It is called
+// at the start of Run, so that each path is stat'd at most once per build
+// (except after it is invalidated by invalidateStats).
+func (m *Maker) startStatCache() (stop func()) {
+	if m.DisableStatCache {
+		return func() {}
+	}
+	m.statCacheMu.Lock()
+	m.statCache = make(map[string]statResult)
+	m.statCacheMu.Unlock()
+	return func() {
+		m.statCacheMu.Lock()
+		m.statCache = nil
+		m.statCacheMu.Unlock()
+	}
+}
+
+// stat calls Stat on m's filesystem, using the cached result if any.
+func (m *Maker) stat(path string) (os.FileInfo, error) {
+	key := filepath.Clean(path)
+	m.statCacheMu.Lock()
+	res, cached := m.statCache[key]
+	m.statCacheMu.Unlock()
+	if cached {
+		return res.fi, res.err
+	}
+
+	fi, err := m.fs().Stat(path)
+	m.statCacheMu.Lock()
+	if m.statCache != nil {
+		m.statCache[key] = statResult{fi, err}
+	}
+	m.statCacheMu.Unlock()
+	return fi, err
+}
+
+// invalidateStats removes the cached Stat results for paths, which may have
+// been created, modified, or removed (for example, by a target's recipes).
+func (m *Maker) invalidateStats(paths ...string) {
+	m.statCacheMu.Lock()
+	defer m.statCacheMu.Unlock()
+	for _, path := range paths {
+		delete(m.statCache, filepath.Clean(path))
+	}
+}
+
+// pathExists and modTime are like Config's, but use the stat cache.
+
+func (m *Maker) pathExists(path string) (bool, error) {
+	_, err := m.stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *Maker) modTime(path string) (time.Time, error) {
+	fi, err := m.stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
@@ -0,0 +1,147 @@
+package makex
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// statCountingFS counts the calls to Stat for each path.
+type statCountingFS struct {
+	FileSystem
+
+	mu    sync.Mutex
+	stats map[string]int
+}
+
+func (fs *statCountingFS) Stat(path string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	fs.stats[filepath.Clean(path)]++
+	fs.mu.Unlock()
+	return fs.FileSystem.Stat(path)
+}
+
+func (fs *statCountingFS) reset() map[string]int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	stats := fs.stats
+	fs.stats = map[string]int{}
+	return stats
+}
+
+// newStatCacheTestMaker returns a Maker for a makefile with n targets that
+// each depend on "src" and are written by the "write" builtin, which appends
+// each target it writes to *built.
+func newStatCacheTestMaker(fs FileSystem, n int, disable bool, built *[]string) *Maker {
+	var mu sync.Mutex
+	conf := &Config{
+		ParallelJobs:     4,
+		FS:               fs,
+		DisableStatCache: disable,
+		Builtins: map[string]func(Rule, []string) error{
+			"write": func(_ Rule, args []string) error {
+				mu.Lock()
+				*built = append(*built, args[0])
+				mu.Unlock()
+				w, err := fs.Create(args[0])
+				if err != nil {
+					return err
+				}
+				return w.Close()
+			},
+		},
+	}
+	all := &BasicRule{TargetFile: "all"}
+	mf := &Makefile{Rules: []Rule{&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"all"}}, all}}
+	for i := 0; i < n; i++ {
+		target := fmt.Sprintf("x%d", i)
+		all.PrereqFiles = append(all.PrereqFiles, target)
+		mf.Rules = append(mf.Rules, &BasicRule{TargetFile: target, PrereqFiles: []string{"src"}, RecipeCmds: []string{"@makex:call write $@"}})
+	}
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	return mk
+}
+
+func TestMaker_Run_statCache(t *testing.T) {
+	const n = 10
+	for _, disable := range []bool{false, true} {
+		// The targets exist but are older than src, so checking whether
+		// each target is stale requires src's mtime.
+		files := map[string]string{"src": ""}
+		for i := 0; i < n; i++ {
+			files[fmt.Sprintf("x%d", i)] = ""
+		}
+		mtfs := newModTimeFileSystem(rwvfs.Map(files))
+		mtfs.(modTimeFileSystem).modTimes["src"] = time.Now()
+		fs := &statCountingFS{FileSystem: mtfs}
+		var built []string
+		mk := newStatCacheTestMaker(fs, n, disable, &built)
+
+		fs.reset()
+		if err := mk.Run(); err != nil {
+			t.Fatalf("disable=%v: %s", disable, err)
+		}
+		if len(built) != n {
+			t.Errorf("disable=%v: got %d targets built, want %d", disable, len(built), n)
+		}
+		stats := fs.reset()
+		want := 1
+		if disable {
+			want = n
+		}
+		if stats["src"] != want {
+			t.Errorf("disable=%v: got %d stats of src, want %d", disable, stats["src"], want)
+		}
+
+		// The targets' new outputs must be seen by later Runs (and by
+		// the rest of the first Run), so nothing should be rebuilt.
+		built = nil
+		if err := mk.Run(); err != nil {
+			t.Fatalf("disable=%v: second Run: %s", disable, err)
+		}
+		if len(built) != 0 {
+			t.Errorf("disable=%v: got targets %v rebuilt, want none", disable, built)
+		}
+	}
+}
+
+func BenchmarkMaker_Run_statCache(b *testing.B) {
+	const n = 5000
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disable=%v", disable), func(b *testing.B) {
+			files := map[string]string{"src": ""}
+			for i := 0; i < n; i++ {
+				files[fmt.Sprintf("x%d", i)] = ""
+			}
+			fs := &statCountingFS{FileSystem: newModTimeFileSystem(rwvfs.Map(files)), stats: map[string]int{}}
+			var built []string
+			mk := newStatCacheTestMaker(fs, n, disable, &built)
+
+			fs.reset()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := mk.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			var stats int
+			for _, count := range fs.reset() {
+				stats += count
+			}
+			b.ReportMetric(float64(stats)/float64(b.N), "stats/op")
+		})
+	}
+}
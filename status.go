@@ -0,0 +1,121 @@
+package makex
+
+import "fmt"
+
+// A TargetStatus is what happened to a target during a build (see
+// BuildResult.Status).
+type TargetStatus int
+
+const (
+	// TargetNotBuilt means that the target needed to be built but wasn't,
+	// because the build failed before reaching it, or that it isn't needed
+	// by the Maker's goals (or Run hasn't been called).
+	TargetNotBuilt TargetStatus = iota
+
+	// TargetBuilt means that the target's recipes ran and succeeded.
+	TargetBuilt
+
+	// TargetCachedRestored means that the target's outputs were restored
+	// from an artifact cache instead of being built. Run doesn't
+	// currently use an artifact cache, so it never reports this status.
+	TargetCachedRestored
+
+	// TargetSkipped means that the target was up to date (or, for
+	// RunTagged, that it wasn't selected).
+	TargetSkipped
+
+	// TargetFailed means that the target's recipes failed.
+	TargetFailed
+
+	// TargetInterrupted means that the build was interrupted (see
+	// Config.GracePeriod) while the target was being built or before it
+	// was started.
+	TargetInterrupted
+
+	// TargetPrereqFailed means that the target wasn't built because one
+	// of its prereqs failed (see Config.KeepGoing).
+	TargetPrereqFailed
+)
+
+func (s TargetStatus) String() string {
+	switch s {
+	case TargetNotBuilt:
+		return "not built"
+	case TargetBuilt:
+		return "built"
+	case TargetCachedRestored:
+		return "restored from cache"
+	case TargetSkipped:
+		return "skipped"
+	case TargetFailed:
+		return "failed"
+	case TargetInterrupted:
+		return "interrupted"
+	case TargetPrereqFailed:
+		return "prereq failed"
+	}
+	return fmt.Sprintf("TargetStatus(%d)", int(s))
+}
+
+// Status returns what happened to target during the build (TargetNotBuilt if
+// target isn't one of the Maker's targets).
+func (r BuildResult) Status(target string) TargetStatus {
+	return r.Statuses[target]
+}
+
+// targetStatuses returns the status of each of m's targets after the most
+// recent call to Run, or nil if Run hasn't been called.
+func (m *Maker) targetStatuses() map[string]TargetStatus {
+	m.statusesMu.Lock()
+	defer m.statusesMu.Unlock()
+	if m.statuses == nil {
+		return nil
+	}
+	statuses := make(map[string]TargetStatus, len(m.rules))
+	for target := range m.rules {
+		// Targets that Run didn't consider building were up to date.
+		statuses[target] = TargetSkipped
+	}
+	for target, status := range m.statuses {
+		statuses[target] = status
+	}
+	return statuses
+}
+
+// resetStatuses forgets the statuses recorded by the previous call to Run.
+func (m *Maker) resetStatuses() {
+	m.statusesMu.Lock()
+	defer m.statusesMu.Unlock()
+	m.statuses = make(map[string]TargetStatus)
+}
+
+func (m *Maker) setStatus(target string, status TargetStatus) {
+	m.statusesMu.Lock()
+	defer m.statusesMu.Unlock()
+	if m.statuses == nil {
+		m.statuses = make(map[string]TargetStatus)
+	}
+	m.statuses[target] = status
+}
+
+// setFailedStatus sets target's status after its build failed.
+func (m *Maker) setFailedStatus(target string) {
+	if m.isInterrupted() {
+		m.setStatus(target, TargetInterrupted)
+	} else {
+		m.setStatus(target, TargetFailed)
+	}
+}
+
+// errInterrupted marks the targets that weren't built because the build was
+// interrupted and returns ErrInterrupted.
+func (m *Maker) errInterrupted() error {
+	m.statusesMu.Lock()
+	defer m.statusesMu.Unlock()
+	for target, status := range m.statuses {
+		if status == TargetNotBuilt {
+			m.statuses[target] = TargetInterrupted
+		}
+	}
+	return ErrInterrupted
+}
@@ -0,0 +1,72 @@
+package makex
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_Result_statuses(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{"uptodate": ""})),
+	}
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: ".PHONY", PrereqFiles: []string{"all", "ok", "bad", "dependent"}},
+		&BasicRule{TargetFile: "all", PrereqFiles: []string{"uptodate", "ok", "dependent"}},
+		&BasicRule{TargetFile: "uptodate"},
+		&BasicRule{TargetFile: "ok", RecipeCmds: []string{"true"}},
+		&BasicRule{TargetFile: "bad", RecipeCmds: []string{"false"}},
+		&BasicRule{TargetFile: "dependent", PrereqFiles: []string{"bad"}, RecipeCmds: []string{"true"}},
+	}}
+	mk := conf.NewMaker(mf, "all")
+	mk.RuleOutput = func(Rule) (io.WriteCloser, io.WriteCloser, *log.Logger) {
+		return nopCloser{ioutil.Discard}, nopCloser{ioutil.Discard}, log.New(ioutil.Discard, "", 0)
+	}
+	if res := mk.Result(); res.Statuses != nil {
+		t.Errorf("before Run, got statuses %v, want nil", res.Statuses)
+	}
+	if err := mk.Run(); err == nil {
+		t.Fatal("got no error from failed recipe")
+	}
+
+	res := mk.Result()
+	want := map[string]TargetStatus{
+		"all":       TargetNotBuilt,
+		"uptodate":  TargetSkipped,
+		"ok":        TargetBuilt,
+		"bad":       TargetFailed,
+		"dependent": TargetNotBuilt,
+	}
+	if !reflect.DeepEqual(res.Statuses, want) {
+		t.Errorf("got statuses %v, want %v", res.Statuses, want)
+	}
+	if got := res.Status("bad"); got != TargetFailed {
+		t.Errorf("got status %v for bad, want %v", got, TargetFailed)
+	}
+	if got := res.Status("nonexistent"); got != TargetNotBuilt {
+		t.Errorf("got status %v for nonexistent target, want %v", got, TargetNotBuilt)
+	}
+}
+
+func TestTargetStatus_String(t *testing.T) {
+	tests := map[TargetStatus]string{
+		TargetNotBuilt:       "not built",
+		TargetBuilt:          "built",
+		TargetCachedRestored: "restored from cache",
+		TargetSkipped:        "skipped",
+		TargetFailed:         "failed",
+		TargetInterrupted:    "interrupted",
+		TargetPrereqFailed:   "prereq failed",
+		TargetStatus(99):     "TargetStatus(99)",
+	}
+	for status, want := range tests {
+		if got := status.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package makex
+
+import (
+	"bytes"
+	"strings"
+)
+
+// isTemplate reports whether target is a template rule's target.
+func isTemplate(target string) bool {
+	i := strings.IndexByte(target, '{')
+	return i != -1 && strings.IndexByte(target[i:], '}') != -1
+}
+
+// isPattern reports whether target is a pattern rule's target.
+func isPattern(target string) bool {
+	return strings.IndexByte(target, '%') != -1
+}
+
+// templateRule is a rule synthesized from a template rule or a pattern rule
+// to make a specific target.
+type templateRule struct {
+	BasicRule
+
+	// vars maps the template's placeholder names to the values they
+	// captured (or, for a pattern rule, "*" to the stem). They are variables
+	// in the recipes.
+	vars map[string]string
+}
+
+// instantiate returns the rule that tmpl (a template rule) would use to make
+// target, or nil if target doesn't match tmpl's target.
+func instantiate(tmpl Rule, target string) Rule {
+	vars, ok := matchTemplate(tmpl.Target(), target, nil)
+	if !ok {
+		return nil
+	}
+	subst := func(s string) string { return substTemplate(s, vars) }
+	return newTemplateRule(tmpl, target, subst, true, vars)
+}
+
+// instantiatePattern returns the rule that pat (a pattern rule) would use to
+// make target, or nil if target doesn't match pat's target.
+func instantiatePattern(pat Rule, target string) Rule {
+	stem, ok := matchPattern(pat.Target(), target)
+	if !ok {
+		return nil
+	}
+	subst := func(s string) string { return strings.Replace(s, "%", stem, 1) }
+	return newTemplateRule(pat, target, subst, false, map[string]string{"*": stem})
+}
+
+// newTemplateRule returns a rule for target that is like tmpl, but with subst
+// applied to its prereqs, outputs, stale inputs, and (if substRecipes is set)
+// recipes.
+func newTemplateRule(tmpl Rule, target string, subst func(string) string, substRecipes bool, vars map[string]string) *templateRule {
+	substAll := func(ss []string) []string {
+		if ss == nil {
+			return nil
+		}
+		out := make([]string, len(ss))
+		for i, s := range ss {
+			out[i] = subst(s)
+		}
+		return out
+	}
+	recipes, sources := tmpl.Recipes(), recipeSourceCmds(tmpl)
+	if substRecipes {
+		recipes, sources = substAll(recipes), substAll(sources)
+	}
+	return &templateRule{
+		BasicRule: BasicRule{
+			TargetFile:       target,
+			PrereqFiles:      substAll(tmpl.Prereqs()),
+			RecipeCmds:       recipes,
+			OutputFiles:      substAll(ruleOutputs(tmpl)[1:]),
+			StaleInputFiles:  substAll(staleInputs(tmpl)),
+			Service:          isService(tmpl),
+			TagNames:         ruleTags(tmpl),
+			Once:             isRunOnce(tmpl),
+			RecipeSourceCmds: sources,
+		},
+		vars: vars,
+	}
+}
+
+// matchPattern matches s against pattern, which contains a "%" that matches
+// 1 or more characters (the stem), and returns the stem.
+func matchPattern(pattern, s string) (stem string, ok bool) {
+	i := strings.IndexByte(pattern, '%')
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(s) <= len(prefix)+len(suffix) || !strings.HasPrefix(s, prefix) || !strings.HasSuffix(s, suffix) {
+		return "", false
+	}
+	return s[len(prefix) : len(s)-len(suffix)], true
+}
+
+// matchTemplate matches s against the template pattern, adding the values
+// captured by pattern's placeholders to vars (which is allocated if nil).
+func matchTemplate(pattern, s string, vars map[string]string) (map[string]string, bool) {
+	open := strings.IndexByte(pattern, '{')
+	if open == -1 {
+		return vars, pattern == s
+	}
+	end := strings.IndexByte(pattern[open:], '}')
+	if end == -1 {
+		return vars, pattern == s
+	}
+	end += open
+
+	if !strings.HasPrefix(s, pattern[:open]) {
+		return vars, false
+	}
+	name, rest := pattern[open+1:end], pattern[end+1:]
+	s = s[open:]
+	for n := 1; n <= len(s); n++ {
+		if prev, bound := vars[name]; bound && prev != s[:n] {
+			continue
+		}
+		captured := make(map[string]string, len(vars)+1)
+		for k, v := range vars {
+			captured[k] = v
+		}
+		captured[name] = s[:n]
+		if captured, ok := matchTemplate(rest, s[n:], captured); ok {
+			return captured, true
+		}
+	}
+	return vars, false
+}
+
+// substTemplate replaces each "{name}" placeholder in s with vars[name].
+// Placeholders whose names aren't in vars are left as is, as are variable
+// references like "${name}".
+func substTemplate(s string, vars map[string]string) string {
+	if strings.IndexByte(s, '{') == -1 {
+		return s
+	}
+	var b bytes.Buffer
+	for {
+		open := strings.IndexByte(s, '{')
+		if open == -1 {
+			break
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end == -1 {
+			break
+		}
+		end += open
+		v, ok := vars[s[open+1:end]]
+		if !ok || (open > 0 && s[open-1] == '$') {
+			b.WriteString(s[:open+1])
+			s = s[open+1:]
+			continue
+		}
+		b.WriteString(s[:open])
+		b.WriteString(v)
+		s = s[end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,300 @@
+package makex
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMatchTemplate(t *testing.T) {
+	tests := map[string]struct {
+		pattern, s string
+		wantVars   map[string]string
+		wantMatch  bool
+	}{
+		"two placeholders": {
+			pattern:   "build-{os}-{arch}",
+			s:         "build-linux-amd64",
+			wantVars:  map[string]string{"os": "linux", "arch": "amd64"},
+			wantMatch: true,
+		},
+		"ambiguous": {
+			pattern:   "{a}-{b}",
+			s:         "x-y-z",
+			wantVars:  map[string]string{"a": "x", "b": "y-z"},
+			wantMatch: true,
+		},
+		"suffix": {
+			pattern:   "{name}.tar.gz",
+			s:         "dist/foo.tar.gz",
+			wantVars:  map[string]string{"name": "dist/foo"},
+			wantMatch: true,
+		},
+		"repeated placeholder": {
+			pattern:   "{x}/{x}",
+			s:         "a/b/a/b",
+			wantVars:  map[string]string{"x": "a/b"},
+			wantMatch: true,
+		},
+		"repeated placeholder mismatch": {
+			pattern: "{x}/{x}",
+			s:       "a/b",
+		},
+		"empty capture": {
+			pattern: "build-{os}",
+			s:       "build-",
+		},
+		"prefix mismatch": {
+			pattern: "build-{os}",
+			s:       "test-linux",
+		},
+	}
+	for label, test := range tests {
+		vars, match := matchTemplate(test.pattern, test.s, nil)
+		if match != test.wantMatch {
+			t.Errorf("%s: got match %v, want %v", label, match, test.wantMatch)
+			continue
+		}
+		if match && !reflect.DeepEqual(vars, test.wantVars) {
+			t.Errorf("%s: got vars %v, want %v", label, vars, test.wantVars)
+		}
+	}
+}
+
+func TestSubstTemplate(t *testing.T) {
+	vars := map[string]string{"os": "linux"}
+	got := substTemplate("GOOS={os} ${os} {arch} {os", vars)
+	if want := "GOOS=linux ${os} {arch} {os"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMakefile_Rule_template(t *testing.T) {
+	mf, err := Parse([]byte(`
+build-{os}-{arch}: main-{os}.go
+	GOOS={os} GOARCH=$(arch) go build -o $@ $<
+
+all: build-linux-amd64
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := mf.Rule("build-linux-amd64")
+	if rule == nil {
+		t.Fatal("got no rule for target matching template")
+	}
+	if want := []string{"main-linux.go"}; !reflect.DeepEqual(rule.Prereqs(), want) {
+		t.Errorf("got prereqs %v, want %v", rule.Prereqs(), want)
+	}
+	if want := []string{"GOOS=linux GOARCH=$(arch) go build -o 'build-linux-amd64' 'main-linux.go'"}; !reflect.DeepEqual(rule.Recipes(), want) {
+		t.Errorf("got recipes %v, want %v", rule.Recipes(), want)
+	}
+
+	if rule := mf.Rule("build-linux"); rule != nil {
+		t.Errorf("got rule %v for target that doesn't match template, want nil", rule)
+	}
+	if rule := mf.DefaultRule(); rule == nil || rule.Target() != "all" {
+		t.Errorf("got default rule %v, want the first non-template rule", rule)
+	}
+}
+
+func TestMaker_Run_template(t *testing.T) {
+	var gotArgs [][]string
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+		Builtins: map[string]func(Rule, []string) error{
+			"record": func(_ Rule, args []string) error {
+				gotArgs = append(gotArgs, args)
+				return nil
+			},
+		},
+	}
+	mf, err := Parse([]byte(`
+.PHONY: build-darwin-arm64
+build-{os}-{arch}:
+	@makex:call record $(os) $(arch) $@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, "build-darwin-arm64")
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"darwin", "arm64", "build-darwin-arm64"}}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("got builtin calls %v, want %v", gotArgs, want)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := map[string]struct {
+		pattern, s string
+		wantStem   string
+		wantMatch  bool
+	}{
+		"suffix":        {pattern: "%.o", s: "dir/x.o", wantStem: "dir/x", wantMatch: true},
+		"prefix":        {pattern: "gen-%", s: "gen-docs", wantStem: "docs", wantMatch: true},
+		"both":          {pattern: "a%.o", s: "abc.o", wantStem: "bc", wantMatch: true},
+		"empty stem":    {pattern: "%.o", s: ".o"},
+		"no match":      {pattern: "%.o", s: "x.c"},
+		"overlapping":   {pattern: "ab%ba", s: "aba"},
+		"prefix only":   {pattern: "gen-%", s: "gen-"},
+		"whole pattern": {pattern: "%", s: "x", wantStem: "x", wantMatch: true},
+	}
+	for label, test := range tests {
+		stem, match := matchPattern(test.pattern, test.s)
+		if match != test.wantMatch {
+			t.Errorf("%s: got match %v, want %v", label, match, test.wantMatch)
+			continue
+		}
+		if stem != test.wantStem {
+			t.Errorf("%s: got stem %q, want %q", label, stem, test.wantStem)
+		}
+	}
+}
+
+func TestMakefile_Rule_pattern(t *testing.T) {
+	mf, err := Parse([]byte(`
+%.o: %.c common.h
+	cc -c -o $@ $< # $*
+
+special.o: special.s
+	as -o $@ $<
+
+%:
+	touch $@
+
+all: x.o
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := mf.Rule("dir/x.o")
+	if rule == nil {
+		t.Fatal("got no rule for target matching pattern")
+	}
+	if want := []string{"dir/x.c", "common.h"}; !reflect.DeepEqual(rule.Prereqs(), want) {
+		t.Errorf("got prereqs %v, want %v", rule.Prereqs(), want)
+	}
+	if want := []string{"cc -c -o $@ $< # $*"}; !reflect.DeepEqual(rule.Recipes(), want) {
+		t.Errorf("got recipes %v, want %v", rule.Recipes(), want)
+	}
+	recipe, err := (&Config{}).NewMaker(mf).expandRecipe(rule, rule.Recipes()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cc -c -o dir/x.o dir/x.c # dir/x"; recipe != want {
+		t.Errorf("got expanded recipe %q, want %q", recipe, want)
+	}
+
+	if rule := mf.Rule("special.o"); rule == nil || !reflect.DeepEqual(rule.Prereqs(), []string{"special.s"}) {
+		t.Errorf("got rule %v for target with an exact rule, want the exact rule", rule)
+	}
+	if rule := mf.Rule("x.c"); rule != nil {
+		t.Errorf("got rule %v for target that only matches a match-anything rule, want nil", rule)
+	}
+	if rule := mf.DefaultRule(); rule == nil || rule.Target() != "special.o" {
+		t.Errorf("got default rule %v, want the first non-pattern rule", rule)
+	}
+}
+
+func TestMaker_Run_pattern(t *testing.T) {
+	gotArgs := map[string][]string{}
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{"a.c": "", "b.c": ""})),
+		Builtins: map[string]func(Rule, []string) error{
+			"record": func(_ Rule, args []string) error {
+				gotArgs[args[0]] = args[1:]
+				return nil
+			},
+		},
+	}
+	mf, err := Parse([]byte(`
+.PHONY: all a.o b.o
+all: a.o b.o
+
+%.o: %.c
+	@makex:call record $@ $< $*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, "all")
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"a.o": {"a.c", "a"}, "b.o": {"b.c", "b"}}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("got builtin calls %v, want %v", gotArgs, want)
+	}
+}
+
+func TestMaker_Run_patternInGo(t *testing.T) {
+	var gotArgs [][]string
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{"dir/x.c": ""})),
+		Builtins: map[string]func(Rule, []string) error{
+			"record": func(_ Rule, args []string) error {
+				gotArgs = append(gotArgs, args)
+				return nil
+			},
+		},
+	}
+	// The makefile isn't parsed, so only the automatic variables are
+	// expanded, but they include the stem.
+	mf := &Makefile{Rules: []Rule{
+		&BasicRule{TargetFile: "%.o", PrereqFiles: []string{"%.c"}, RecipeCmds: []string{"@makex:call record $@ $< $* $(stem)"}},
+	}}
+	mk := conf.NewMaker(mf, "dir/x.o")
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"dir/x.o", "dir/x.c", "dir/x", "$(stem)"}}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("got builtin calls %q, want %q", gotArgs, want)
+	}
+}
+
+func TestMaker_Run_patternWithoutPrereqs(t *testing.T) {
+	var built []string
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{"lib.o": "", "main.c": ""})),
+		Builtins: map[string]func(Rule, []string) error{
+			"record": func(_ Rule, args []string) error {
+				built = append(built, args[0])
+				return nil
+			},
+		},
+	}
+	// lib.o is checked in, and there is no lib.c to make it from, so it is
+	// used as is.
+	mf, err := Parse([]byte(`
+.PHONY: all main.o
+all: lib.o main.o
+	@makex:call record $@
+
+%.o: %.c
+	@makex:call record $@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := conf.NewMaker(mf, "all")
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"main.o", "all"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("got targets built %v, want %v", built, want)
+	}
+	if rule := mk.rule("lib.o"); rule != nil {
+		t.Errorf("got rule %v for lib.o, want nil (lib.c doesn't exist)", rule)
+	}
+	if rule := mf.Rule("lib.o"); rule == nil {
+		t.Error("got no rule from Makefile.Rule for lib.o, want the pattern rule (it doesn't check the filesystem)")
+	}
+}
@@ -0,0 +1,158 @@
+package makex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// A TargetTiming records when a target's recipes ran during a build.
+type TargetTiming struct {
+	Target string
+
+	// Slot is the worker slot (in [0, ParallelJobs)) that ran the target.
+	// Targets with the same Slot never ran concurrently.
+	Slot int
+
+	Start, End time.Time
+
+	// Recipes are the expanded recipe commands that were run (up to and
+	// including the one that failed, if any).
+	Recipes []string
+
+	// Err is the error that caused the target's build to fail, or nil if it
+	// succeeded.
+	Err error
+}
+
+// Duration returns how long the target took to build.
+func (t TargetTiming) Duration() time.Duration { return t.End.Sub(t.Start) }
+
+// Timeline returns the timing of each target built during the most recent
+// call to Run, ordered by start time.
+func (m *Maker) Timeline() []TargetTiming {
+	m.timelineMu.Lock()
+	defer m.timelineMu.Unlock()
+	timeline := make([]TargetTiming, len(m.timeline))
+	copy(timeline, m.timeline)
+	sort.Sort(timingsByStart(timeline))
+	return timeline
+}
+
+func (m *Maker) recordTiming(t TargetTiming) {
+	m.timelineMu.Lock()
+	defer m.timelineMu.Unlock()
+	m.timeline = append(m.timeline, t)
+}
+
+type timingsByStart []TargetTiming
+
+func (v timingsByStart) Len() int           { return len(v) }
+func (v timingsByStart) Less(i, j int) bool { return v[i].Start.Before(v[j].Start) }
+func (v timingsByStart) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// A BuildResult breaks down how long each phase of a build took, to show
+// whether a slow build is spent parsing the makefile, resolving the goals'
+// dependency graph, or running recipes. It also records what happened to each
+// target.
+type BuildResult struct {
+	// ParseDuration is how long it took to parse (and expand) the
+	// makefile (see Makefile.ParseDuration).
+	ParseDuration time.Duration
+
+	// DAGDuration is how long NewMaker took to resolve the goals'
+	// dependency graph.
+	DAGDuration time.Duration
+
+	// RunDuration is how long the most recent call to Run took, including
+	// checking which targets are stale and any retries.
+	RunDuration time.Duration
+
+	// Timeline is the timing of each target built during the most recent
+	// call to Run (see Timeline).
+	Timeline []TargetTiming
+
+	// Statuses maps each of the Maker's targets to what happened to it
+	// during the most recent call to Run (see Status). It is nil if Run
+	// hasn't been called.
+	Statuses map[string]TargetStatus
+}
+
+// Result returns the timing breakdown and target statuses of the Maker's most
+// recent build.
+func (m *Maker) Result() BuildResult {
+	return BuildResult{
+		ParseDuration: m.mf.ParseDuration,
+		DAGDuration:   m.dagDuration,
+		RunDuration:   m.runDuration,
+		Timeline:      m.Timeline(),
+		Statuses:      m.targetStatuses(),
+	}
+}
+
+// traceEvent is an event in Chrome's trace event format. See
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU.
+type traceEvent struct {
+	Name     string                 `json:"name"`
+	Category string                 `json:"cat,omitempty"`
+	Phase    string                 `json:"ph"`
+	Time     int64                  `json:"ts"`
+	Duration int64                  `json:"dur,omitempty"`
+	PID      int                    `json:"pid"`
+	TID      int                    `json:"tid"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteTrace writes the timeline of the most recent call to Run to w in
+// Chrome's trace event JSON format, which can be loaded into chrome://tracing
+// or Perfetto. Each worker slot is shown as a thread, and each target is a
+// duration event on the thread of the slot that built it.
+func (m *Maker) WriteTrace(w io.Writer) error {
+	timeline := m.Timeline()
+
+	var epoch time.Time
+	if len(timeline) > 0 {
+		epoch = timeline[0].Start
+	}
+
+	events := []traceEvent{}
+	slots := map[int]struct{}{}
+	for _, t := range timeline {
+		if _, seen := slots[t.Slot]; !seen {
+			slots[t.Slot] = struct{}{}
+			events = append(events, traceEvent{
+				Name:  "thread_name",
+				Phase: "M",
+				PID:   1,
+				TID:   t.Slot,
+				Args:  map[string]interface{}{"name": fmt.Sprintf("worker %d", t.Slot)},
+			})
+		}
+
+		recipes := t.Recipes
+		if recipes == nil {
+			recipes = []string{}
+		}
+		args := map[string]interface{}{"recipes": recipes}
+		if t.Err != nil {
+			args["error"] = t.Err.Error()
+		}
+		events = append(events, traceEvent{
+			Name:     t.Target,
+			Category: "target",
+			Phase:    "X",
+			Time:     int64(t.Start.Sub(epoch) / time.Microsecond),
+			Duration: int64(t.Duration() / time.Microsecond),
+			PID:      1,
+			TID:      t.Slot,
+			Args:     args,
+		})
+	}
+
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
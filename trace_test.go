@@ -0,0 +1,95 @@
+package makex
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestMaker_WriteTrace(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 2,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+	}
+	mf := &Makefile{
+		Rules: []Rule{
+			&BasicRule{TargetFile: "x", PrereqFiles: []string{"y0", "y1"}, RecipeCmds: []string{"true $@"}},
+			&BasicRule{TargetFile: "y0", RecipeCmds: []string{"true"}},
+			&BasicRule{TargetFile: "y1", RecipeCmds: []string{"true"}},
+		},
+	}
+	mk := conf.NewMaker(mf, "x")
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if timeline := mk.Timeline(); len(timeline) != 3 {
+		t.Fatalf("got %d timings, want 3", len(timeline))
+	} else if last := timeline[2]; last.Target != "x" || !reflect.DeepEqual(last.Recipes, []string{"true x"}) {
+		t.Errorf("got last timing %+v, want target x with recipes [true x]", last)
+	}
+
+	var buf bytes.Buffer
+	if err := mk.WriteTrace(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, ev := range trace.TraceEvents {
+		if ev.Phase == "X" {
+			targets = append(targets, ev.Name)
+		}
+	}
+	sort.Strings(targets)
+	if want := []string{"x", "y0", "y1"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("got trace events for targets %v, want %v", targets, want)
+	}
+}
+
+func TestMaker_Result(t *testing.T) {
+	conf := &Config{
+		ParallelJobs: 1,
+		FS:           NewFileSystem(rwvfs.Map(map[string]string{})),
+	}
+	mf, err := Parse([]byte(`
+.PHONY: x
+x:
+	sleep 0.01
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mf.ParseDuration <= 0 {
+		t.Errorf("got ParseDuration %v, want > 0", mf.ParseDuration)
+	}
+	mk := conf.NewMaker(mf, "x")
+	if res := mk.Result(); res.RunDuration != 0 || len(res.Timeline) != 0 {
+		t.Errorf("before Run, got result %+v, want no run duration or timeline", res)
+	}
+	if err := mk.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := mk.Result()
+	if res.ParseDuration != mf.ParseDuration {
+		t.Errorf("got ParseDuration %v, want %v", res.ParseDuration, mf.ParseDuration)
+	}
+	if res.DAGDuration <= 0 {
+		t.Errorf("got DAGDuration %v, want > 0", res.DAGDuration)
+	}
+	if len(res.Timeline) != 1 {
+		t.Fatalf("got %d timings, want 1", len(res.Timeline))
+	}
+	if d := res.Timeline[0].Duration(); res.RunDuration < d {
+		t.Errorf("got RunDuration %v, want at least the target's duration %v", res.RunDuration, d)
+	}
+}
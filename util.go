@@ -2,9 +2,11 @@ package makex
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
+// Errors is a list of errors that occurred during a build.
 type Errors []error
 
 func (e Errors) Error() string {
@@ -17,3 +19,33 @@ func (e Errors) Error() string {
 	}
 	return fmt.Sprintf("multiple errors (%d):\n%s", len(e), strings.Join(es, "\n"))
 }
+
+// Unwrap returns the errors in e, so that errors.Is and errors.As can find
+// errors (such as a RecipeError) in any of them.
+func (e Errors) Unwrap() []error { return e }
+
+// sort orders e by the target names of its RuleBuildErrors. Other errors are
+// placed after all RuleBuildErrors, in their original order.
+func (e Errors) sort() { sort.Stable(errorsByTarget(e)) }
+
+type errorsByTarget Errors
+
+func (v errorsByTarget) Len() int      { return len(v) }
+func (v errorsByTarget) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v errorsByTarget) Less(i, j int) bool {
+	ti, iok := errorTarget(v[i])
+	tj, jok := errorTarget(v[j])
+	if iok && jok {
+		return ti < tj
+	}
+	return iok && !jok
+}
+
+// errorTarget returns the target whose build failed with err, if err is a
+// RuleBuildError.
+func errorTarget(err error) (string, bool) {
+	if e, ok := err.(RuleBuildError); ok {
+		return e.Rule.Target(), true
+	}
+	return "", false
+}